@@ -0,0 +1,211 @@
+package CVLAN
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cvlan/core/crypto"
+	"io"
+	"net"
+	"time"
+)
+
+// Alert is the payload of a recordAlert record. After the handshake alerts
+// are sealed like data, so the peer can't be fooled by an injected or
+// truncated stream. A failing handshake sends one in the clear before it
+// closes, the keys may be what failed.
+type Alert uint8
+
+const (
+	// the sender won't write anymore, everything before it was delivered
+	alertCloseNotify Alert = iota
+
+	// AlertBadVersion: the peer speaks another protocol version.
+	AlertBadVersion
+	// AlertHandshakeFailure: no suite both sides support.
+	AlertHandshakeFailure
+	// AlertAuthFailed: a certificate, static key, token or ticket peer was
+	// refused.
+	AlertAuthFailed
+	// AlertDecryptError: handshake messages didn't decrypt or verify, the
+	// sides derived other keys.
+	AlertDecryptError
+	// AlertDecodeError: a handshake message was malformed.
+	AlertDecodeError
+	// AlertInternalError: the handshake failed for another reason.
+	AlertInternalError
+)
+
+func (a Alert) String() string {
+	switch a {
+	case alertCloseNotify:
+		return "close notify"
+	case AlertBadVersion:
+		return "bad version"
+	case AlertHandshakeFailure:
+		return "handshake failure"
+	case AlertAuthFailed:
+		return "auth failed"
+	case AlertDecryptError:
+		return "decrypt error"
+	case AlertDecodeError:
+		return "decode error"
+	case AlertInternalError:
+		return "internal error"
+	}
+	return fmt.Sprintf("alert(%d)", uint8(a))
+}
+
+// Error makes alerts usable as sentinels, errors.Is(err, AlertAuthFailed)
+// holds for every AlertError with that code.
+func (a Alert) Error() string {
+	return a.String()
+}
+
+// AlertError is a failed handshake, either reported by the peer's alert or
+// detected here and sent to the peer as one. A handshake step can return one
+// to choose the alert the peer gets.
+type AlertError struct {
+	Alert Alert
+	// Remote is set when the peer sent the alert.
+	Remote bool
+	// Err is what failed here. For a remote alert it is what the alert
+	// means for this side when that is known, ErrPSKMismatch for a decrypt
+	// error with a PSK configured, nil otherwise.
+	Err error
+}
+
+func (e *AlertError) Error() string {
+	if e.Remote {
+		if e.Err != nil {
+			return "remote alert: " + e.Alert.String() + ": " + e.Err.Error()
+		}
+		return "remote alert: " + e.Alert.String()
+	}
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Alert.String()
+}
+
+func (e *AlertError) Unwrap() error {
+	return e.Err
+}
+
+func (e *AlertError) Is(target error) bool {
+	if a, ok := target.(Alert); ok {
+		return a == e.Alert
+	}
+	// remote alerts match the sentinel the peer failed with
+	switch e.Alert {
+	case AlertBadVersion:
+		return target == ErrUnsupportedVersion
+	case AlertHandshakeFailure:
+		return target == ErrNoCommonSuite
+	}
+	return false
+}
+
+// authFailure marks an error as a refused peer.
+type authFailure struct{ error }
+
+func (e authFailure) Unwrap() error { return e.error }
+
+// alertFor picks the alert telling the peer why the handshake failed.
+func alertFor(err error) Alert {
+	var alertErr *AlertError
+	switch {
+	case errors.As(err, &alertErr):
+		return alertErr.Alert
+	case errors.Is(err, ErrUnsupportedVersion):
+		return AlertBadVersion
+	case errors.Is(err, ErrNoCommonSuite):
+		return AlertHandshakeFailure
+	case errors.Is(err, ErrBadCertificate), errors.Is(err, ErrUnauthorized), errors.As(err, &authFailure{}):
+		return AlertAuthFailed
+	case errors.Is(err, ErrTranscriptMismatch), errors.Is(err, ErrPSKMismatch), errors.Is(err, crypto.ErrDecrypt):
+		return AlertDecryptError
+	case errors.Is(err, errMalformedHello), errors.Is(err, errMalformedShare), errors.Is(err, errMalformedTicket):
+		return AlertDecodeError
+	}
+	return AlertInternalError
+}
+
+// how long Close waits for the close_notify alert to be written, and a
+// failed handshake for its alert
+const (
+	closeNotifyTimeout    = 5 * time.Second
+	handshakeAlertTimeout = time.Second
+)
+
+var errUnexpectedAlert = errors.New("unexpected alert")
+
+// abortHandshake sends the alert for err and returns err as an AlertError.
+// Failures of the transport and alerts from the peer are returned as they
+// are, nobody would read an answer.
+func (c *Conn) abortHandshake(err error) error {
+	var alertErr *AlertError
+	if errors.As(err, &alertErr) && alertErr.Remote {
+		// the peer derived other keys, with a PSK on this side that is the
+		// likely reason
+		if alertErr.Alert == AlertDecryptError && alertErr.Err == nil && c.hs != nil && c.hs.psk != nil {
+			alertErr.Err = ErrPSKMismatch
+		}
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) || errors.As(err, &netErr) {
+		return err
+	}
+
+	a := alertFor(err)
+	timer := time.AfterFunc(handshakeAlertTimeout, func() { c.conn.Close() })
+	c.writeRecord(recordAlert, []byte{byte(a)})
+	timer.Stop()
+
+	if alertErr != nil {
+		return err
+	}
+	return &AlertError{Alert: a, Err: err}
+}
+
+func (c *Conn) sendAlert(a Alert) error {
+	return c.writeSealed(recordAlert, []byte{byte(a)})
+}
+
+func (c *Conn) handleAlert(msg []byte) error {
+	if len(msg) != 1 {
+		return errUnexpectedAlert
+	}
+	if a := Alert(msg[0]); a != alertCloseNotify {
+		return &AlertError{Alert: a, Remote: true}
+	}
+	c.readClosed = true
+	return nil
+}
+
+// closeNotify sends close_notify once, the caller holds writeMu.
+func (c *Conn) closeNotify() error {
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	return c.sendAlert(alertCloseNotify)
+}
+
+// CloseWrite tells the peer that nothing more will be written, its Read
+// returns io.EOF once it has read everything before. Reading goes on until
+// the peer closes too. The transport's write side is shut down as well when
+// it supports that.
+func (c *Conn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.closeNotify(); err != nil {
+		return err
+	}
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package CVLAN
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrUnauthorized is returned by the server's handshake when the Authorizer
+// refused the client, which gets AlertAuthFailed.
+var ErrUnauthorized = errors.New("client not authorized")
+
+var (
+	errMalformedToken   = errors.New("malformed token")
+	errTokenToAnonymous = errors.New("token would be sent to an unauthenticated server")
+)
+
+// Claims is what an accepted token says about the client.
+type Claims struct {
+	Subject string            `json:"sub"`
+	Expires time.Time         `json:"exp"`
+	Extra   map[string]string `json:"ext,omitempty"`
+}
+
+// Authorizer decides on the server whether a client may join, by the token
+// it sent. An error refuses the client, the claims end up on the Conn.
+type Authorizer interface {
+	Authorize(token []byte) (*Claims, error)
+}
+
+// AuthorizerFunc adapts a function to an Authorizer.
+type AuthorizerFunc func(token []byte) (*Claims, error)
+
+func (f AuthorizerFunc) Authorize(token []byte) (*Claims, error) { return f(token) }
+
+// HMACAuthorizer issues and checks tokens signed with a key shared by the
+// issuer and the servers. A token is the claims in JSON and their HMAC-SHA256,
+// both base64url encoded and joined by a dot.
+type HMACAuthorizer struct {
+	Key []byte
+}
+
+func (a *HMACAuthorizer) mac(payload string) []byte {
+	mac := hmac.New(sha256.New, a.Key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Issue returns a token carrying claims.
+func (a *HMACAuthorizer) Issue(claims *Claims) ([]byte, error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return []byte(payload + "." + base64.RawURLEncoding.EncodeToString(a.mac(payload))), nil
+}
+
+// Authorize accepts a token signed with Key that hasn't expired.
+func (a *HMACAuthorizer) Authorize(token []byte) (*Claims, error) {
+	payload, sig, ok := strings.Cut(string(token), ".")
+	if !ok {
+		return nil, errMalformedToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	if !hmac.Equal(mac, a.mac(payload)) {
+		return nil, errors.New("bad token signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	var claims Claims
+	if err = json.Unmarshal(b, &claims); err != nil {
+		return nil, errMalformedToken
+	}
+	if claims.Expires.IsZero() || time.Now().After(claims.Expires) {
+		return nil, errors.New("token expired")
+	}
+	return &claims, nil
+}
+
+// Claims returns the claims the server's Authorizer accepted, nil without
+// one. On the client it is always nil.
+func (c *Conn) Claims() *Claims {
+	return c.claims
+}
+
+// serverHandshakeWithAuthorize reads the client's token and lets the
+// Authorizer judge it. The client always sends one, empty without a token.
+type serverHandshakeWithAuthorize struct{ *Conn }
+
+func (e *serverHandshakeWithAuthorize) Do() error {
+	token, err := e.ReadEncrypted()
+	if err != nil || e.hs.authorizer == nil {
+		return err
+	}
+
+	claims, err := e.hs.authorizer.Authorize(token)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	e.claims = claims
+	return nil
+}
+
+// clientHandshakeWithAuthorize sends the token, a refusal arrives as an
+// alert in place of the server's next message.
+type clientHandshakeWithAuthorize struct{ *Conn }
+
+func (e *clientHandshakeWithAuthorize) Do() error {
+	return e.WriteEncrypted(e.hs.token)
+}
+
+func (ServerHandshake) Authorize(conn *Conn) HandShake { return &serverHandshakeWithAuthorize{conn} }
+func (ClientHandshake) Authorize(conn *Conn) HandShake { return &clientHandshakeWithAuthorize{conn} }
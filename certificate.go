@@ -0,0 +1,174 @@
+package CVLAN
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/cvlan/core/util"
+	"time"
+)
+
+const (
+	labelServerCertVerify = "cvlan server certificate verify"
+	labelClientCertVerify = "cvlan client certificate verify"
+)
+
+// ErrBadCertificate is returned when the peer's certificate chain or its
+// signature of the handshake doesn't check out, or it sent none but one is
+// required.
+var ErrBadCertificate = errors.New("bad certificate")
+
+var errServerNameRequired = errors.New("roots set without a server name to verify")
+
+// Certificate is a chain this side presents, DER encoded with the leaf
+// first, and the Ed25519 key of the leaf that signs the handshake.
+type Certificate struct {
+	Chain [][]byte
+	Key   ed25519.PrivateKey
+}
+
+// check rejects a certificate this side can't present, before the
+// handshake starts.
+func (cert *Certificate) check() error {
+	if cert == nil {
+		return nil
+	}
+	if len(cert.Chain) == 0 || len(cert.Chain) > 0xff {
+		return errors.New("certificate chain must have 1 to 255 certificates")
+	}
+	if len(cert.Key) != ed25519.PrivateKeySize {
+		return errors.New("certificate key is not an Ed25519 private key")
+	}
+	return nil
+}
+
+// certificateMsg carries the chain and the signature of the transcript up
+// to it, empty when this side has no certificate.
+//
+//	n | (len16 | der)... | len16 | signature
+func marshalCertificateMsg(chain [][]byte, sig []byte) []byte {
+	b := []byte{uint8(len(chain))}
+	for _, der := range chain {
+		b = append(b, util.TypeEncoder[uint16](uint16(len(der)))...)
+		b = append(b, der...)
+	}
+	b = append(b, util.TypeEncoder[uint16](uint16(len(sig)))...)
+	return append(b, sig...)
+}
+
+func unmarshalCertificateMsg(b []byte) (chain [][]byte, sig []byte, err error) {
+	r := helloReader{b: b}
+	for n := r.u8(); n > 0 && r.err == nil; n-- {
+		chain = append(chain, r.bytes16())
+	}
+	sig = r.bytes16()
+	if err = r.done(); err != nil {
+		return nil, nil, fmt.Errorf("%w: malformed message", ErrBadCertificate)
+	}
+	return chain, sig, nil
+}
+
+// signedCertificate is what the signature covers: whose it is, the
+// transcript before the message and the chain, so it can't be replayed in
+// another handshake or by the other side.
+func signedCertificate(label string, transcript []byte, chain [][]byte) []byte {
+	b := append([]byte(label), transcript...)
+	return append(b, marshalCertificateMsg(chain, nil)...)
+}
+
+// PeerCertificates returns the peer's verified chain, leaf first, nil when
+// it presented none or no roots to verify it against were configured.
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	return c.peerCertificates
+}
+
+func (c *Conn) writeCertificate(label string) error {
+	cert := c.hs.certificate
+	if cert == nil {
+		return c.WriteEncrypted(marshalCertificateMsg(nil, nil))
+	}
+	sig := ed25519.Sign(cert.Key, signedCertificate(label, c.keys.transcript.Sum(nil), cert.Chain))
+	return c.WriteEncrypted(marshalCertificateMsg(cert.Chain, sig))
+}
+
+func (c *Conn) readCertificate(label string, usage x509.ExtKeyUsage) error {
+	th := c.keys.transcript.Sum(nil)
+	msg, err := c.ReadEncrypted()
+	if err != nil {
+		return err
+	}
+	chain, sig, err := unmarshalCertificateMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	// without roots there is nothing to trust a chain to
+	if c.hs.roots == nil {
+		return nil
+	}
+	if len(chain) == 0 {
+		return fmt.Errorf("%w: peer sent no certificate", ErrBadCertificate)
+	}
+
+	certs := make([]*x509.Certificate, len(chain))
+	for i, der := range chain {
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return fmt.Errorf("%w: %v", ErrBadCertificate, err)
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       c.hs.serverName,
+		Roots:         c.hs.roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadCertificate, err)
+	}
+
+	pub, ok := certs[0].PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: not an Ed25519 key", ErrBadCertificate)
+	}
+	if !ed25519.Verify(pub, signedCertificate(label, th, chain), sig) {
+		return fmt.Errorf("%w: handshake signature", ErrBadCertificate)
+	}
+	c.peerCertificates = chains[0]
+	return nil
+}
+
+// serverHandshakeWithCertificate and clientHandshakeWithCertificate
+// exchange certificate chains, the server's first. Each side signs the
+// transcript with its leaf's key, so the chain is bound to this handshake.
+// A side without a certificate sends an empty message, which only fails
+// when the peer has roots configured.
+type serverHandshakeWithCertificate struct{ *Conn }
+
+func (e *serverHandshakeWithCertificate) Do() error {
+	if err := e.writeCertificate(labelServerCertVerify); err != nil {
+		return err
+	}
+	return e.readCertificate(labelClientCertVerify, x509.ExtKeyUsageClientAuth)
+}
+
+type clientHandshakeWithCertificate struct{ *Conn }
+
+func (e *clientHandshakeWithCertificate) Do() error {
+	if err := e.readCertificate(labelServerCertVerify, x509.ExtKeyUsageServerAuth); err != nil {
+		return err
+	}
+	return e.writeCertificate(labelClientCertVerify)
+}
+
+func (ServerHandshake) Certificate(conn *Conn) HandShake {
+	return &serverHandshakeWithCertificate{conn}
+}
+func (ClientHandshake) Certificate(conn *Conn) HandShake {
+	return &clientHandshakeWithCertificate{conn}
+}
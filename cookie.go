@@ -0,0 +1,99 @@
+package CVLAN
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"github.com/cvlan/core/util"
+	"net"
+	"time"
+)
+
+// how long a cookie is accepted after it was issued
+const cookieLifetime = 30 * time.Second
+
+var (
+	// ErrBadCookie is returned by the server when a client answered a
+	// cookie request without a valid cookie.
+	ErrBadCookie = errors.New("missing or invalid cookie")
+
+	errCookieKey   = errors.New("cookie policy without key")
+	errSecondRetry = errors.New("server asked for a cookie twice")
+)
+
+// CookiePolicy makes the server answer a client's hello with a cookie before
+// it does any key exchange. Only a client that echoes the cookie in a second
+// hello gets the expensive part. The cookie is a MAC of the client's address
+// and the time, the server keeps no state for a client it hasn't heard back
+// from.
+type CookiePolicy struct {
+	// Key MACs the cookies, it must be set.
+	Key []byte
+	// Required reports whether a handshake starting now asks for a cookie,
+	// nil means always. Listener asks only under load.
+	Required func() bool
+}
+
+// cookie: issued (unix seconds) | HMAC-SHA256(key, issued | client address)
+func (p *CookiePolicy) mac(issued []byte, addr string) []byte {
+	mac := hmac.New(sha256.New, p.Key)
+	mac.Write([]byte("cvlan cookie"))
+	mac.Write(issued)
+	mac.Write([]byte(addr))
+	return mac.Sum(nil)
+}
+
+func (p *CookiePolicy) issue(addr string) []byte {
+	issued := util.TypeEncoder[int64](time.Now().Unix())
+	return append(issued, p.mac(issued, addr)...)
+}
+
+func (p *CookiePolicy) valid(cookie []byte, addr string) bool {
+	if len(cookie) != 8+sha256.Size {
+		return false
+	}
+	age := time.Since(time.Unix(util.TypeDecoder[int64](cookie[:8]), 0))
+	if age < -time.Second || age > cookieLifetime {
+		return false
+	}
+	return hmac.Equal(cookie[8:], p.mac(cookie[:8], addr))
+}
+
+// cookieAddr is the client's address a cookie is bound to. The port is left
+// out, a client may come back on another connection.
+func (c *Conn) cookieAddr() string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// checkCookie reports whether the hello may go on to the key exchange, or
+// answers it with a cookie request and starts the transcript over. Either
+// side forgets the first hello, the second one binds the cookie.
+func (c *Conn) checkCookie(hello *clientHello, retried bool) (bool, error) {
+	policy := c.hs.cookies
+	if policy == nil {
+		return true, nil
+	}
+	if retried {
+		if !policy.valid(hello.cookie, c.cookieAddr()) {
+			return false, ErrBadCookie
+		}
+		return true, nil
+	}
+	if policy.Required != nil && !policy.Required() {
+		return true, nil
+	}
+	if policy.valid(hello.cookie, c.cookieAddr()) {
+		return true, nil
+	}
+
+	retry := &serverHello{version: ProtocolVersion, retry: true, share: policy.issue(c.cookieAddr())}
+	if _, err := c.WriteAsBytes(retry.marshal()); err != nil {
+		return false, err
+	}
+	c.keys.resetTranscript()
+	return false, nil
+}
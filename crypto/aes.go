@@ -3,9 +3,7 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"io"
-	"math"
 )
 
 type AES interface {
@@ -18,84 +16,30 @@ type AES interface {
 	StreamDecrypt(r io.Reader, w io.Writer, nextIV func() []byte) error
 }
 
+// GCM is AES-GCM with implicit counter nonces, see sequencedAEAD. Messages
+// have to be opened in the order they were sealed by the peer.
 type GCM struct {
-	c    cipher.Block
-	aead cipher.AEAD
+	*sequencedAEAD
 }
 
-func (g *GCM) Encrypt(msg []byte, _ []byte) ([]byte, error) {
-	nonce := make([]byte, g.aead.NonceSize())
-	io.ReadFull(rand.Reader, nonce)
-	cipherText := g.aead.Seal(nil, nonce, msg, nil)
-	cipherText = append(cipherText, nonce...)
-	return cipherText, nil
-}
-
-func (g *GCM) Decrypt(msg []byte, _ []byte) ([]byte, error) {
-	cipherTextSize := len(msg)
-	nonceSize := g.aead.NonceSize()
-	return g.aead.Open(nil, msg[cipherTextSize-nonceSize:], msg[:cipherTextSize-nonceSize], nil)
-}
-
-func (g *GCM) StreamEncrypt(src io.Reader, dst io.Writer, _ func() []byte) error {
-	as := NewAEStream()
-
-	p := make([]byte, math.MaxUint32/256)
-	for {
-		n, err := src.Read(p[:])
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-		cipherText, err := g.Encrypt(p[:n], nil)
-		if err != nil {
-			return err
-		}
-
-		if err = as.Append(
-			cipherText[len(cipherText)-g.aead.NonceSize():],
-			cipherText[:len(cipherText)-g.aead.NonceSize()],
-		); err != nil {
-			return err
-		}
-	}
-
-	return as.Encoding(dst)
-}
-
-func (g *GCM) StreamDecrypt(src io.Reader, dst io.Writer, _ func() []byte) error {
-	as, err := ReadAEStream(src)
+// NewGCM returns a GCM sealing with sealKey and opening with openKey, the
+// peer uses the same keys the other way around.
+func NewGCM(sealKey, openKey []byte) (AES, error) {
+	seal, err := newGCM(sealKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if err = as.Iter(func(nonce, payload []byte) error {
-		// iter aes stream
-		text, pErr := g.Decrypt(append(payload, nonce...), nil)
-		if pErr != nil {
-			return pErr
-		}
-
-		// write decrypt result
-		if _, pErr = dst.Write(text); pErr != nil {
-			return pErr
-		}
-
-		return nil
-	}); err != nil {
-		return err
+	open, err := newGCM(openKey)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
+	return &GCM{sequencedAEAD: newSequencedAEAD(seal, open)}, nil
 }
 
-func NewGCM(key []byte) (AES, error) {
+func newGCM(key []byte) (cipher.AEAD, error) {
 	cipherBlock, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	aead, err := cipher.NewGCM(cipherBlock)
-	return &GCM{c: cipherBlock, aead: aead}, nil
+	return cipher.NewGCM(cipherBlock)
 }
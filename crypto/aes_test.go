@@ -0,0 +1,129 @@
+package crypto_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/cvlan/core/crypto"
+	"testing"
+)
+
+func newGCMPair(t *testing.T) (client, server crypto.AES) {
+	return newPair(t, crypto.NewGCM)
+}
+
+func newPair(t *testing.T, newAES func(sealKey, openKey []byte) (crypto.AES, error)) (client, server crypto.AES) {
+	t.Helper()
+	c2s, s2c := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	client, err := newAES(c2s, s2c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = newAES(s2c, c2s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestGCM_Sequence(t *testing.T) {
+	client, server := newGCMPair(t)
+
+	var records [][]byte
+	for _, msg := range []string{"first", "second", "third"} {
+		record, err := client.Encrypt([]byte(msg), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(record) != len(msg)+16 {
+			t.Fatalf("record carries %d extra bytes", len(record)-len(msg))
+		}
+		records = append(records, record)
+	}
+
+	if _, err := server.Decrypt(records[1], nil); !errors.Is(err, crypto.ErrOutOfOrder) {
+		t.Fatalf("reordered record: got %v", err)
+	}
+	if text, err := server.Decrypt(records[0], nil); err != nil || string(text) != "first" {
+		t.Fatalf("got %q, %v", text, err)
+	}
+	if _, err := server.Decrypt(records[0], nil); !errors.Is(err, crypto.ErrReplay) {
+		t.Fatalf("replayed record: got %v", err)
+	}
+
+	records[1][0] ^= 1
+	if _, err := server.Decrypt(records[1], nil); !errors.Is(err, crypto.ErrDecrypt) {
+		t.Fatalf("forged record: got %v", err)
+	}
+}
+
+func TestGCM_Directions(t *testing.T) {
+	client, server := newGCMPair(t)
+
+	// both sides seal their first record with sequence number zero, the
+	// directional keys keep them apart
+	c, _ := client.Encrypt([]byte("ping"), nil)
+	s, _ := server.Encrypt([]byte("ping"), nil)
+	if bytes.Equal(c, s) {
+		t.Fatal("client and server share a nonce")
+	}
+
+	// a record can't be reflected back to its sender
+	if _, err := client.Decrypt(c, nil); err == nil {
+		t.Fatal("reflected record accepted")
+	}
+	if text, err := client.Decrypt(s, nil); err != nil || string(text) != "ping" {
+		t.Fatalf("got %q, %v", text, err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := server.StreamEncrypt(bytes.NewReader([]byte("stream")), buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := client.StreamDecrypt(buf, out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "stream" {
+		t.Fatalf("got %q", out.String())
+	}
+}
+
+func TestChaCha20Poly1305(t *testing.T) {
+	for name, newAES := range map[string]func(sealKey, openKey []byte) (crypto.AES, error){
+		"ChaCha20Poly1305":  crypto.NewChaCha20Poly1305,
+		"XChaCha20Poly1305": crypto.NewXChaCha20Poly1305,
+	} {
+		client, server := newPair(t, newAES)
+
+		first, _ := client.Encrypt([]byte("first"), nil)
+		second, _ := client.Encrypt([]byte("second"), nil)
+		if len(first) != len("first")+16 {
+			t.Fatalf("%s: record carries %d extra bytes", name, len(first)-len("first"))
+		}
+		if _, err := server.Decrypt(second, nil); !errors.Is(err, crypto.ErrOutOfOrder) {
+			t.Fatalf("%s: reordered record: got %v", name, err)
+		}
+		if text, err := server.Decrypt(first, nil); err != nil || string(text) != "first" {
+			t.Fatalf("%s: got %q, %v", name, text, err)
+		}
+		if _, err := server.Decrypt(first, nil); !errors.Is(err, crypto.ErrReplay) {
+			t.Fatalf("%s: replayed record: got %v", name, err)
+		}
+		if _, err := client.Decrypt(second, nil); err == nil {
+			t.Fatalf("%s: reflected record accepted", name)
+		}
+
+		buf := &bytes.Buffer{}
+		if err := server.StreamEncrypt(bytes.NewReader([]byte("stream")), buf, nil); err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		if err := client.StreamDecrypt(buf, out, nil); err != nil || out.String() != "stream" {
+			t.Fatalf("%s: got %q, %v", name, out.String(), err)
+		}
+	}
+
+	if _, err := crypto.NewChaCha20Poly1305(make([]byte, 16), make([]byte, 16)); err == nil {
+		t.Fatal("short key accepted")
+	}
+}
@@ -0,0 +1,50 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ChaCha20Poly1305 is ChaCha20-Poly1305 with implicit counter nonces, like
+// GCM. It is fast without AES instructions.
+type ChaCha20Poly1305 struct {
+	*sequencedAEAD
+}
+
+// XChaCha20Poly1305 is ChaCha20Poly1305 with 24 byte nonces, the counter
+// takes their last 8 bytes.
+type XChaCha20Poly1305 struct {
+	*sequencedAEAD
+}
+
+// NewChaCha20Poly1305 returns a ChaCha20Poly1305 sealing with sealKey and
+// opening with openKey, both 32 bytes.
+func NewChaCha20Poly1305(sealKey, openKey []byte) (AES, error) {
+	s, err := newSequencedPair(chacha20poly1305.New, sealKey, openKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ChaCha20Poly1305{sequencedAEAD: s}, nil
+}
+
+// NewXChaCha20Poly1305 returns a XChaCha20Poly1305 sealing with sealKey and
+// opening with openKey, both 32 bytes.
+func NewXChaCha20Poly1305(sealKey, openKey []byte) (AES, error) {
+	s, err := newSequencedPair(chacha20poly1305.NewX, sealKey, openKey)
+	if err != nil {
+		return nil, err
+	}
+	return &XChaCha20Poly1305{sequencedAEAD: s}, nil
+}
+
+func newSequencedPair(newAEAD func(key []byte) (cipher.AEAD, error), sealKey, openKey []byte) (*sequencedAEAD, error) {
+	seal, err := newAEAD(sealKey)
+	if err != nil {
+		return nil, err
+	}
+	open, err := newAEAD(openKey)
+	if err != nil {
+		return nil, err
+	}
+	return newSequencedAEAD(seal, open), nil
+}
@@ -1,9 +1,34 @@
 package crypto
 
+import (
+	"crypto/rand"
+	"golang.org/x/crypto/curve25519"
+	"io"
+)
+
 type PriKey struct {
 	Key [32]byte
 }
 
+func (k *PriKey) Public() *PubKey {
+	var pub [32]byte
+	curve25519.ScalarBaseMult(&pub, &k.Key)
+	return &PubKey{Key: pub}
+}
+
 type PubKey struct {
 	Key [32]byte
 }
+
+// GeneratePriKey returns a random Curve25519 private key, usable as a long
+// term identity.
+func GeneratePriKey() (*PriKey, error) {
+	var pri [32]byte
+	if _, err := io.ReadFull(rand.Reader, pri[:]); err != nil {
+		return nil, err
+	}
+	pri[0] &= 248
+	pri[31] &= 127
+	pri[31] |= 64
+	return &PriKey{Key: pri}, nil
+}
@@ -6,7 +6,6 @@ import (
 	"crypto/rand"
 	"errors"
 	"golang.org/x/crypto/curve25519"
-	"io"
 	"math/big"
 )
 
@@ -47,17 +46,13 @@ func (e *curve25519ECDH) GenerateShared(pub *PubKey) (*[]byte, error) {
 }
 
 func NewCurve25519ECDH() (ECDH[PubKey], error) {
-	var pub, pri [32]byte
-	if _, err := io.ReadFull(rand.Reader, pri[:]); err != nil {
+	pri, err := GeneratePriKey()
+	if err != nil {
 		return nil, err
 	}
-	pri[0] &= 248
-	pri[31] &= 127
-	pri[31] |= 64
-	curve25519.ScalarBaseMult(&pub, &pri)
 	return &curve25519ECDH{
-		pri: &PriKey{Key: pri},
-		pub: &PubKey{Key: pub},
+		pri: pri,
+		pub: pri.Public(),
 	}, nil
 }
 
@@ -85,7 +80,8 @@ func (e *ellipticECDH) Unmarshal(b []byte) (*ecdsa.PublicKey, error) {
 
 func (e *ellipticECDH) GenerateShared(pub *ecdsa.PublicKey) (*[]byte, error) {
 	x, _ := e.curve.ScalarMult(pub.X, pub.Y, e.d)
-	v := x.Bytes()
+	// fixed size, so leading zeros don't shorten the key
+	v := x.FillBytes(make([]byte, (e.curve.Params().BitSize+7)/8))
 	return &v, nil
 }
 
@@ -0,0 +1,157 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+var (
+	ErrReplay          = errors.New("crypto: replayed record")
+	ErrOutOfOrder      = errors.New("crypto: record out of order")
+	ErrDecrypt         = errors.New("crypto: message authentication failed")
+	ErrSequenceOverrun = errors.New("crypto: sequence number exhausted")
+)
+
+// StreamEncrypt seals its input in blocks of at most this size
+const streamBlockSize = 1 << 16
+
+// how far before or after the expected sequence number a failed record is
+// looked up to tell a replayed or reordered record from a forged one
+const sequenceWindow = 16
+
+// sequence is the implicit nonce of one direction. Every sealed or opened
+// message advances it by one, so the nonce never travels on the wire and a
+// message is only accepted at the position it was sent at.
+type sequence struct {
+	aead cipher.AEAD
+	next uint64
+}
+
+func (s *sequence) nonce(seq uint64) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// sequencedAEAD seals and opens messages of one session with counter nonces.
+// Each direction has its own key, so both can count from zero.
+type sequencedAEAD struct {
+	sealMu sync.Mutex
+	seal   sequence
+
+	openMu sync.Mutex
+	open   sequence
+}
+
+func (s *sequencedAEAD) Seal(msg []byte) ([]byte, error) {
+	s.sealMu.Lock()
+	defer s.sealMu.Unlock()
+
+	if s.seal.next == math.MaxUint64 {
+		return nil, ErrSequenceOverrun
+	}
+	nonce := s.seal.nonce(s.seal.next)
+	s.seal.next++
+	return s.seal.aead.Seal(nil, nonce, msg, nil), nil
+}
+
+func (s *sequencedAEAD) Open(msg []byte) ([]byte, error) {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+
+	if s.open.next == math.MaxUint64 {
+		return nil, ErrSequenceOverrun
+	}
+	text, err := s.open.aead.Open(nil, s.open.nonce(s.open.next), msg, nil)
+	if err == nil {
+		s.open.next++
+		return text, nil
+	}
+
+	// the record is authentic but was sealed at another position
+	for i := uint64(1); i <= sequenceWindow; i++ {
+		if i <= s.open.next {
+			if _, err = s.open.aead.Open(nil, s.open.nonce(s.open.next-i), msg, nil); err == nil {
+				return nil, ErrReplay
+			}
+		}
+		if _, err = s.open.aead.Open(nil, s.open.nonce(s.open.next+i), msg, nil); err == nil {
+			return nil, ErrOutOfOrder
+		}
+	}
+	return nil, ErrDecrypt
+}
+
+// Encrypt, Decrypt and the stream methods implement AES for every cipher
+// built on a sequencedAEAD, the iv arguments are ignored.
+
+func (s *sequencedAEAD) Encrypt(msg []byte, _ []byte) ([]byte, error) {
+	return s.Seal(msg)
+}
+
+func (s *sequencedAEAD) Decrypt(msg []byte, _ []byte) ([]byte, error) {
+	return s.Open(msg)
+}
+
+func (s *sequencedAEAD) StreamEncrypt(src io.Reader, dst io.Writer, _ func() []byte) error {
+	as := NewAEStream()
+
+	p := make([]byte, streamBlockSize)
+	for {
+		n, err := src.Read(p[:])
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		cipherText, err := s.Encrypt(p[:n], nil)
+		if err != nil {
+			return err
+		}
+
+		// the nonce is implicit, blocks carry none
+		if err = as.Append(nil, cipherText); err != nil {
+			return err
+		}
+	}
+
+	return as.Encoding(dst)
+}
+
+func (s *sequencedAEAD) StreamDecrypt(src io.Reader, dst io.Writer, _ func() []byte) error {
+	as, err := ReadAEStream(src)
+	if err != nil {
+		return err
+	}
+
+	if err = as.Iter(func(_, payload []byte) error {
+		// iter aes stream
+		text, pErr := s.Decrypt(payload, nil)
+		if pErr != nil {
+			return pErr
+		}
+
+		// write decrypt result
+		if _, pErr = dst.Write(text); pErr != nil {
+			return pErr
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func newSequencedAEAD(seal, open cipher.AEAD) *sequencedAEAD {
+	return &sequencedAEAD{
+		seal: sequence{aead: seal},
+		open: sequence{aead: open},
+	}
+}
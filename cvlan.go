@@ -1,166 +1,445 @@
 package CVLAN
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/x509"
 	"errors"
 	"github.com/cvlan/core/crypto"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var _ net.Conn = (*Conn)(nil)
+
 type Conn struct {
-	SessionSecret []byte
+	keys *keySchedule
 
 	crypt      crypto.AES
+	readCrypt  crypto.AES
+	writeCrypt crypto.AES
+	client     bool
+	kex        KeyExchange
+	cipher     Cipher
+	rekey      rekeyState
+	keepalive  keepaliveState
+
+	hs           *handshakeState
+	peerIdentity *crypto.PubKey
+	ticket       *Ticket
+	claims       *Claims
+
+	peerCertificates []*x509.Certificate
+	// the session was resumed, the static keys are known from the ticket
+	resumed bool
+
+	// values of handshake steps, see StateKey
+	stateMu sync.RWMutex
+	state   map[any]any
+
 	readBuffer *bytes.Buffer
+	readMu     sync.Mutex
+	writeMu    sync.Mutex
+	// Writes waiting for or holding writeMu
+	writers    atomic.Int32
 	ctx        context.Context
 	cancelFunc context.CancelCauseFunc
 
-	conn *net.TCPConn
+	conn   io.ReadWriteCloser
+	reader *bufio.Reader
+
+	// bytes of the record being read, kept across timed out reads
+	in []byte
+	// set once a record was only partly written, the stream is unusable
+	writeErr error
+
+	// close_notify was received or sent
+	readClosed  bool
+	writeClosed bool
+	// the handshake is done, Close sends close_notify from then on
+	established bool
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
 
 	Timeout time.Duration
 }
 
+// handshake runs the steps, a failure is reported to the peer with an alert
+// and returned as an AlertError.
 func (c *Conn) handshake(hs ...HandShake) (err error) {
 	for _, h := range hs {
 		if err = h.Do(); err != nil {
-			return
+			return c.abortHandshake(err)
 		}
 	}
+
+	if c.writeCrypt, c.readCrypt, err = c.keys.finish(); err != nil {
+		return
+	}
+	c.rekey.reset()
+	c.established = true
+	c.hs = nil
+	c.startKeepalive()
 	return
 }
 
+// deadline returns the earlier of the deadline set by the user and the one
+// implied by Timeout for an operation starting now.
+func (c *Conn) deadline(user time.Time) time.Time {
+	if c.Timeout <= 0 {
+		return user
+	}
+	if t := time.Now().Add(c.Timeout); user.IsZero() || t.Before(user) {
+		return t
+	}
+	return user
+}
+
 func (c *Conn) write(r io.Reader) (int64, error) {
-	c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
-	defer c.conn.SetWriteDeadline(time.Time{})
-	return c.conn.ReadFrom(r)
-}
-
-func (c *Conn) read(w io.Writer) (n int64, err error) {
-	buf := make([]byte, 512)
-	for {
-		c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
-		nr, er := c.conn.Read(buf)
-		c.conn.SetReadDeadline(time.Time{})
-		switch {
-		case er != nil:
-			err = er
-			return
-		case nr == 512:
-			nw, ew := w.Write(buf)
-			if nw > 0 {
-				n += int64(nw)
-			}
-			if ew != nil {
-				err = ew
-				return
+	c.deadlineMu.Lock()
+	setWriteDeadline(c.conn, c.deadline(c.writeDeadline))
+	c.deadlineMu.Unlock()
+
+	// TCP sockets take the buffer without another copy
+	if rf, ok := c.conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(c.conn, r)
+}
+
+// read reads into p until it is full or an error occurs and returns the
+// number of bytes read.
+func (c *Conn) read(p []byte) (int, error) {
+	c.deadlineMu.Lock()
+	setReadDeadline(c.conn, c.deadline(c.readDeadline))
+	c.deadlineMu.Unlock()
+	return io.ReadFull(c.reader, p)
+}
+
+// Read returns io.EOF only after the peer closed with close_notify. A
+// transport that ends without it fails with io.ErrUnexpectedEOF, since the
+// stream may have been cut short.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	c.keepalive.readSince.Store(time.Now().UnixNano())
+	defer c.keepalive.readSince.Store(0)
+
+	for c.readBuffer.Len() == 0 {
+		if c.readClosed {
+			return 0, io.EOF
+		}
+
+		typ, text, err := c.readSealed()
+		if err != nil {
+			if cause := context.Cause(c.ctx); errors.Is(cause, ErrPeerDead) {
+				err = cause
+			} else if err == io.EOF {
+				err = io.ErrUnexpectedEOF
 			}
-		case n < 512:
-			nw, ew := w.Write(buf[:nr])
-			if nw > 0 {
-				n += int64(nw)
+			return 0, err
+		}
+
+		switch typ {
+		case recordData:
+			c.readBuffer.Write(text)
+		case recordRekey:
+			if err = c.handleRekey(text); err != nil {
+				return 0, err
 			}
-			if ew != nil {
-				err = ew
-				return
+		case recordAlert:
+			if err = c.handleAlert(text); err != nil {
+				return 0, err
 			}
-			return
+		case recordKeepalive:
 		default:
-			err = errors.New("readFull failed")
-			return
+			return 0, errUnexpectedRecord
 		}
 	}
+	return c.readBuffer.Read(p)
 }
 
-func (c *Conn) Read(p []byte) (n int, err error) {
-Start:
-	if c.readBuffer.Len() == 0 {
-		goto Read
+// Write seals p into one or more data records. Records are opened by the
+// peer in the order they were sealed, so the lock covers both steps.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	c.writers.Add(1)
+	defer c.writers.Add(-1)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.writeClosed {
+		return 0, io.ErrClosedPipe
 	}
-	return c.readBuffer.Read(p)
 
-Read:
-	rbuf := bytesBufferPool.Alloc()
-	defer rbuf.Free()
-	for {
-		if c.readBuffer.Len() > 0 {
-			goto Start
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRecordPlaintext {
+			chunk = chunk[:maxRecordPlaintext]
 		}
 
-		if _, err = c.read(rbuf.Val()); err != nil {
-			if err == io.EOF {
-				goto Start
-			}
+		if err = c.writeSealed(recordData, chunk); err != nil {
 			return
 		}
+		n += len(chunk)
+		p = p[len(chunk):]
 
-		if err = c.crypt.StreamDecrypt(rbuf.Val(), c.readBuffer, nil); err != nil {
+		if err = c.accountWrite(len(chunk)); err != nil {
 			return
 		}
 	}
+	return
 }
 
-func (c *Conn) Write(p []byte) (n int, err error) {
-	cryptBuf := bytesBufferPool.Alloc()
-	defer cryptBuf.Free()
-	err = c.crypt.StreamEncrypt(bytes.NewReader(p), cryptBuf.Val(), nil)
-	if err != nil {
+// WriteAsBytes sends b as a single handshake record, it becomes part of the
+// handshake transcript.
+func (c *Conn) WriteAsBytes(b []byte) (int64, error) {
+	if err := c.writeRecord(recordHandshake, b); err != nil {
 		return 0, err
 	}
-	nn, err := io.Copy(c.conn, cryptBuf.Val())
-	return int(nn), err
-}
-
-func (c *Conn) WriteAsBytes(b []byte) (int64, error) {
-	buf := bytes.NewBuffer(b)
-	defer func() { buf = nil }()
-	return c.write(buf)
+	c.keys.addMessage(b)
+	return int64(len(b)), nil
 }
 
+// ReadAsBytes returns the payload of the next handshake record, it becomes
+// part of the handshake transcript.
 func (c *Conn) ReadAsBytes() ([]byte, error) {
-	buf := bytesBufferPool.Alloc()
-	defer buf.Free()
-	_, err := c.read(buf.Val())
+	b, err := c.readRecordOf(recordHandshake)
 	if err != nil {
 		return nil, err
 	}
-	return buf.Val().Bytes(), nil
+	c.keys.addMessage(b)
+	return b, nil
+}
+
+// PeerPublicKey returns the static public key the peer proved to own during
+// the handshake.
+func (c *Conn) PeerPublicKey() *crypto.PubKey {
+	return c.peerIdentity
+}
+
+// Suite returns the key exchange and cipher negotiated in the handshake.
+func (c *Conn) Suite() (KeyExchange, Cipher) {
+	return c.kex, c.cipher
+}
+
+// Context is cancelled when the connection is closed or the peer is declared
+// dead, context.Cause tells which.
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if a, ok := c.conn.(addresser); ok {
+		return a.LocalAddr()
+	}
+	return transportAddr{}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if a, ok := c.conn.(addresser); ok {
+		return a.RemoteAddr()
+	}
+	return transportAddr{}
+}
+
+// SetDeadline sets the read and write deadlines, see SetReadDeadline and
+// SetWriteDeadline.
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for Read calls, including a pending one.
+// It fails with os.ErrNoDeadline when the transport has no deadlines.
+// Timeout still bounds every single socket read when it expires first. A
+// record cut short by the deadline is kept, so Read can be retried after the
+// deadline was extended.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return setReadDeadline(c.conn, c.deadline(t))
+}
+
+// SetWriteDeadline sets the deadline for Write calls, including a pending
+// one. Timeout still bounds every single socket write when it expires first.
+// A Write that timed out in the middle of a record leaves the stream broken
+// and all later writes return the same error.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return setWriteDeadline(c.conn, c.deadline(t))
 }
 
+// Close sends close_notify unless CloseWrite already did and closes the
+// transport. The alert is skipped when a Write is still blocked, and given
+// up after closeNotifyTimeout when the peer doesn't take it. A keepalive
+// being written is waited for.
 func (c *Conn) Close() error {
+	if c.established && c.writers.Load() == 0 {
+		timer := time.AfterFunc(closeNotifyTimeout, func() { c.conn.Close() })
+		c.writeMu.Lock()
+		c.closeNotify()
+		c.writeMu.Unlock()
+		timer.Stop()
+	}
+
 	c.cancelFunc(errors.New("connect close"))
 	return c.conn.Close()
 }
 
-func makeConnect(ctx context.Context, conn *net.TCPConn, timeout time.Duration) *Conn {
+func makeConnect(ctx context.Context, conn io.ReadWriteCloser, timeout time.Duration, client bool) *Conn {
 	ctx, cancel := context.WithCancelCause(ctx)
 	return &Conn{
-		SessionSecret: nil,
-		crypt:         nil,
-		readBuffer:    &bytes.Buffer{},
-		ctx:           ctx,
-		cancelFunc:    cancel,
-		conn:          conn,
-		Timeout:       timeout,
+		keys:       newKeySchedule(client),
+		crypt:      nil,
+		client:     client,
+		readBuffer: &bytes.Buffer{},
+		ctx:        ctx,
+		cancelFunc: cancel,
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		Timeout:    timeout,
 	}
 }
 
 type ClientCfg struct {
 	Context context.Context
-	Conn    *net.TCPConn
-	Timeout time.Duration
+	// Conn is the transport, usually a net.Conn. Deadlines and Timeout
+	// only apply when it has SetReadDeadline and SetWriteDeadline.
+	Conn      io.ReadWriteCloser
+	Timeout   time.Duration
+	Rekey     RekeyPolicy
+	Keepalive KeepalivePolicy
+
+	// Identity is the static key the client proves to own, a fresh one is
+	// used for this connection when nil.
+	Identity *crypto.PriKey
+	// VerifyPeer judges the peer's static key during the handshake, an
+	// error aborts it. Without it every peer is accepted.
+	VerifyPeer func(peer *crypto.PubKey) error
+
+	// PSK is a secret shared out of band. When set, only a peer holding
+	// the same one completes the handshake, others fail with ErrPSKMismatch.
+	PSK []byte
+
+	// KeyExchanges and Ciphers are the suites offered, in preference order.
+	// X25519 and AES256GCM are used when empty.
+	KeyExchanges []KeyExchange
+	Ciphers      []Cipher
+
+	// Certificate is presented to the server, which verifies it when it has
+	// roots configured.
+	Certificate *Certificate
+	// Roots verify the server's certificate, which has to be valid for
+	// ServerName, it must be set with them. When nil the server isn't asked
+	// to prove a certificate.
+	Roots      *x509.CertPool
+	ServerName string
+
+	// KnownPeers pins the server's static key under ServerName, or the
+	// remote address without one. The first key seen is recorded, a
+	// different key later fails the handshake with ErrPeerKeyChanged.
+	// VerifyPeer still runs first.
+	KnownPeers KnownPeers
+
+	// Token is sent to the server's Authorizer after the handshake was
+	// verified, see HMACAuthorizer. A refused client fails with
+	// ErrUnauthorized. It is a bearer credential, whoever receives it can
+	// use it: NewClient refuses it unless VerifyPeer, KnownPeers, Roots or
+	// PSK authenticate the server.
+	Token []byte
+
+	// Ticket resumes the session it was issued for with an abbreviated
+	// handshake, see Conn.Ticket. A full handshake is done when the server
+	// doesn't accept it.
+	Ticket *Ticket
+
+	// Steps run in order after the built-in handshake, over the encrypted
+	// channel, see Conn.WriteEncrypted. The peer has to run matching steps.
+	// They pass values on with SetState, which stay on the Conn.
+	Steps []func(conn *Conn) HandShake
+}
+
+// check rejects a config no handshake can succeed with, and returns the
+// suites it offers.
+func (cfg *ClientCfg) check() ([]KeyExchange, []Cipher, error) {
+	kexs, ciphers, err := checkSuites(cfg.KeyExchanges, cfg.Ciphers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = cfg.Certificate.check(); err != nil {
+		return nil, nil, err
+	}
+	if cfg.Roots != nil && cfg.ServerName == "" {
+		return nil, nil, errServerNameRequired
+	}
+	if len(cfg.Token) > 0 && cfg.VerifyPeer == nil && cfg.KnownPeers == nil && cfg.Roots == nil && len(cfg.PSK) == 0 {
+		return nil, nil, errTokenToAnonymous
+	}
+	return kexs, ciphers, nil
 }
 
+// NewClient runs the client handshake over cfg.Conn. It is closed when the
+// handshake fails, but not when cfg is rejected before it starts.
 func NewClient(cfg *ClientCfg) (*Conn, error) {
-	conn := makeConnect(cfg.Context, cfg.Conn, cfg.Timeout)
+	hs, err := newHandshakeState(cfg.Identity, cfg.VerifyPeer)
+	if err != nil {
+		return nil, err
+	}
+	if hs.kexs, hs.ciphers, err = cfg.check(); err != nil {
+		return nil, err
+	}
+
+	conn := makeConnect(cfg.Context, cfg.Conn, cfg.Timeout, true)
+	conn.rekey.policy = cfg.Rekey
+	conn.keepalive.policy = cfg.Keepalive
+	conn.hs = hs
+	conn.hs.psk = cfg.PSK
+	conn.hs.ticket = cfg.Ticket
+	conn.hs.token = cfg.Token
+	conn.hs.certificate, conn.hs.roots, conn.hs.serverName = cfg.Certificate, cfg.Roots, cfg.ServerName
+	if cfg.KnownPeers != nil {
+		conn.hs.knownPeers, conn.hs.peerName = cfg.KnownPeers, cfg.ServerName
+		if conn.hs.peerName == "" {
+			conn.hs.peerName = conn.RemoteAddr().String()
+		}
+		verifyPeer := cfg.VerifyPeer
+		conn.hs.verifyPeer = func(peer *crypto.PubKey) error {
+			if verifyPeer != nil {
+				if err := verifyPeer(peer); err != nil {
+					return err
+				}
+			}
+			return conn.knownPeer(peer)
+		}
+	}
 
 	clientHandshake := &ClientHandshake{}
-	if err := conn.handshake(
+	steps := []HandShake{
 		clientHandshake.ECDH(conn),
+		clientHandshake.PSK(conn),
+		clientHandshake.Identity(conn),
+		clientHandshake.Certificate(conn),
 		clientHandshake.Verify(conn),
-	); err != nil {
+		clientHandshake.KnownPeers(conn),
+		clientHandshake.Authorize(conn),
+		clientHandshake.Ticket(conn),
+	}
+	for _, step := range cfg.Steps {
+		steps = append(steps, step(conn))
+	}
+	if err = conn.handshake(steps...); err != nil {
 		conn.Close()
 		return nil, err
 	}
@@ -170,18 +449,109 @@ func NewClient(cfg *ClientCfg) (*Conn, error) {
 
 type ServerCfg struct {
 	Context context.Context
-	Conn    *net.TCPConn
-	Timeout time.Duration
+	// Conn is the transport, see ClientCfg.Conn.
+	Conn      io.ReadWriteCloser
+	Timeout   time.Duration
+	Rekey     RekeyPolicy
+	Keepalive KeepalivePolicy
+
+	// Identity is the static key the server proves to own, a fresh one is
+	// used for this connection when nil.
+	Identity *crypto.PriKey
+	// VerifyPeer judges the peer's static key during the handshake, an
+	// error aborts it. Without it every peer is accepted.
+	VerifyPeer func(peer *crypto.PubKey) error
+
+	// PSK is a secret shared out of band. When set, only a peer holding
+	// the same one completes the handshake, others fail with ErrPSKMismatch.
+	PSK []byte
+
+	// KeyExchanges and Ciphers are the suites accepted, the client's
+	// preference order picks among them. X25519 and AES256GCM are used
+	// when empty.
+	KeyExchanges []KeyExchange
+	Ciphers      []Cipher
+
+	// Certificate is presented to the client, which verifies it when it has
+	// roots configured.
+	Certificate *Certificate
+	// Roots verify client certificates, a client without a valid one is
+	// refused. When nil clients aren't asked for one.
+	Roots *x509.CertPool
+
+	// Authorizer decides whether a client may join by its token, every
+	// client may without one. It runs on resumed sessions too, and before
+	// tickets are issued.
+	Authorizer Authorizer
+
+	// Cookies makes the server ask for a cookie before the key exchange,
+	// against floods of handshakes. Listener sets one up under load.
+	Cookies *CookiePolicy
+
+	// Tickets makes the server issue resumption tickets sealed with these
+	// keys and accept them back. Create them with NewTicketKeys or SetKeys.
+	Tickets *TicketKeys
+
+	// Steps run in order after the built-in handshake, over the encrypted
+	// channel, see Conn.WriteEncrypted. The peer has to run matching steps.
+	// They pass values on with SetState, which stay on the Conn.
+	Steps []func(conn *Conn) HandShake
 }
 
+// check rejects a config no handshake can succeed with, and returns the
+// suites it accepts.
+func (cfg *ServerCfg) check() ([]KeyExchange, []Cipher, error) {
+	kexs, ciphers, err := checkSuites(cfg.KeyExchanges, cfg.Ciphers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Cookies != nil && len(cfg.Cookies.Key) == 0 {
+		return nil, nil, errCookieKey
+	}
+	if err = cfg.Certificate.check(); err != nil {
+		return nil, nil, err
+	}
+	if cfg.Tickets != nil && cfg.Tickets.empty() {
+		return nil, nil, errNoTicketKeys
+	}
+	return kexs, ciphers, nil
+}
+
+// NewServer runs the server handshake over cfg.Conn. It is closed when the
+// handshake fails, but not when cfg is rejected before it starts.
 func NewServer(cfg *ServerCfg) (*Conn, error) {
-	conn := makeConnect(cfg.Context, cfg.Conn, cfg.Timeout)
+	hs, err := newHandshakeState(cfg.Identity, cfg.VerifyPeer)
+	if err != nil {
+		return nil, err
+	}
+	if hs.kexs, hs.ciphers, err = cfg.check(); err != nil {
+		return nil, err
+	}
+
+	conn := makeConnect(cfg.Context, cfg.Conn, cfg.Timeout, false)
+	conn.rekey.policy = cfg.Rekey
+	conn.keepalive.policy = cfg.Keepalive
+	conn.hs = hs
+	conn.hs.psk = cfg.PSK
+	conn.hs.tickets = cfg.Tickets
+	conn.hs.authorizer = cfg.Authorizer
+	conn.hs.cookies = cfg.Cookies
+	conn.hs.certificate, conn.hs.roots = cfg.Certificate, cfg.Roots
 
 	serverHandshake := &ServerHandshake{}
-	if err := conn.handshake(
+	steps := []HandShake{
 		serverHandshake.ECDH(conn),
+		serverHandshake.PSK(conn),
+		serverHandshake.Identity(conn),
+		serverHandshake.Certificate(conn),
 		serverHandshake.Verify(conn),
-	); err != nil {
+		serverHandshake.Authorize(conn),
+		serverHandshake.Ticket(conn),
+	}
+	for _, step := range cfg.Steps {
+		steps = append(steps, step(conn))
+	}
+	if err = conn.handshake(steps...); err != nil {
 		conn.Close()
 		return nil, err
 	}
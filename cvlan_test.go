@@ -0,0 +1,1154 @@
+package CVLAN_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	CVLAN "github.com/cvlan/core"
+	"github.com/cvlan/core/crypto"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// relay forwards everything between a and b one byte per write, so every
+// record crosses the socket split into single byte segments.
+func relay(a, b *net.TCPConn) {
+	pipe := func(dst, src *net.TCPConn) {
+		buf := make([]byte, 1)
+		for {
+			if _, err := src.Read(buf); err != nil {
+				dst.CloseWrite()
+				return
+			}
+			if _, err := dst.Write(buf); err != nil {
+				return
+			}
+		}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+}
+
+func newPair(t *testing.T, byteByByte bool, setup func(*CVLAN.ClientCfg, *CVLAN.ServerCfg)) (client, server *CVLAN.Conn) {
+	t.Helper()
+
+	listener, err := CVLAN.NewTCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	addr := listener.Addr().String()
+	if byteByByte {
+		proxy, err := CVLAN.NewTCPListener("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { proxy.Close() })
+
+		go func(target string) {
+			in, err := proxy.AcceptTCP()
+			if err != nil {
+				return
+			}
+			out, err := CVLAN.NewTCPDialer(target)
+			if err != nil {
+				in.Close()
+				return
+			}
+			in.SetNoDelay(true)
+			out.SetNoDelay(true)
+			relay(in, out)
+		}(addr)
+		addr = proxy.Addr().String()
+	}
+
+	clientCfg := &CVLAN.ClientCfg{Context: context.Background(), Timeout: 5 * time.Second}
+	serverCfg := &CVLAN.ServerCfg{Context: context.Background(), Timeout: 5 * time.Second}
+	if setup != nil {
+		setup(clientCfg, serverCfg)
+	}
+
+	serverCh := make(chan *CVLAN.Conn, 1)
+	go func() {
+		tcpConn, err := listener.AcceptTCP()
+		if err != nil {
+			t.Error(err)
+			serverCh <- nil
+			return
+		}
+		serverCfg.Conn = tcpConn
+		conn, err := CVLAN.NewServer(serverCfg)
+		if err != nil {
+			t.Error(err)
+		}
+		serverCh <- conn
+	}()
+
+	tcpConn, err := CVLAN.NewTCPDialer(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Conn = tcpConn
+	client, err = CVLAN.NewClient(clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server = <-serverCh; server == nil {
+		t.FailNow()
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func testTransfer(t *testing.T, byteByByte bool) {
+	client, server := newPair(t, byteByByte, nil)
+
+	messages := [][]byte{
+		[]byte("Hello"),
+		bytes.Repeat([]byte{0xab}, 1<<10),
+		bytes.Repeat([]byte("cvlan"), 1<<15),
+	}
+
+	// write everything before reading anything, so records pile up in the
+	// socket and have to be told apart by the record layer alone
+	go func() {
+		for _, msg := range messages {
+			if _, err := client.Write(msg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for _, msg := range messages {
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("message mismatch, got %d bytes want %d bytes", len(got), len(msg))
+		}
+	}
+}
+
+func TestConn_Transfer(t *testing.T) {
+	testTransfer(t, false)
+}
+
+func TestConn_TransferByteByByte(t *testing.T) {
+	testTransfer(t, true)
+}
+
+func TestConn_Rekey(t *testing.T) {
+	client, server := newPair(t, false, func(c *CVLAN.ClientCfg, s *CVLAN.ServerCfg) {
+		c.Rekey = CVLAN.RekeyPolicy{Records: 3}
+		s.Rekey = CVLAN.RekeyPolicy{Bytes: 1 << 10}
+	})
+	secret := append([]byte(nil), CVLAN.TrafficSecret(client)...)
+
+	// echo everything back, so both directions rekey with records in flight
+	go io.Copy(server, server)
+
+	const count = 64
+	go func() {
+		for i := 0; i < count; i++ {
+			if _, err := client.Write(bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		got := make([]byte, 100)
+		if _, err := io.ReadFull(client, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, bytes.Repeat([]byte{byte(i)}, 100)) {
+			t.Fatalf("message %d corrupted", i)
+		}
+	}
+
+	if bytes.Equal(secret, CVLAN.TrafficSecret(client)) {
+		t.Fatal("session was never rekeyed")
+	}
+}
+
+func TestConn_RekeyWriteOnly(t *testing.T) {
+	// the server never writes and the client never reads, over a transport
+	// without buffering
+	client, server, clientErr, serverErr := handshakePipe(t,
+		&CVLAN.ClientCfg{Rekey: CVLAN.RekeyPolicy{Records: 3}},
+		&CVLAN.ServerCfg{},
+	)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+
+	secrets := map[string]bool{}
+	const count = 100
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			if _, err := client.Write([]byte{byte(i)}); err != nil {
+				done <- err
+				return
+			}
+			secrets[string(CVLAN.TrafficSecret(client))] = true
+		}
+		done <- nil
+	}()
+
+	got := make([]byte, count)
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range got {
+		if b != byte(i) {
+			t.Fatalf("byte %d corrupted", i)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) < count/3 {
+		t.Fatalf("send keys replaced %d times", len(secrets)-1)
+	}
+}
+
+func TestConn_Deadline(t *testing.T) {
+	client, server := newPair(t, false, nil)
+
+	if server.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Fatalf("server sees %s, client is %s", server.RemoteAddr(), client.LocalAddr())
+	}
+
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var netErr net.Error
+	if _, err := server.Read(make([]byte, 1)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	// the deadline stays in place until it is changed
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	server.SetReadDeadline(time.Time{})
+	if _, err := client.Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(server, got); err != nil || string(got) != "late" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+// rwc hides everything of a net.Conn but io.ReadWriteCloser
+type rwc struct{ io.ReadWriteCloser }
+
+func TestConn_Transport(t *testing.T) {
+	for name, wrap := range map[string]func(net.Conn) io.ReadWriteCloser{
+		"pipe": func(c net.Conn) io.ReadWriteCloser { return c },
+		"rwc":  func(c net.Conn) io.ReadWriteCloser { return rwc{c} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			a, b := net.Pipe()
+
+			serverCh := make(chan *CVLAN.Conn, 1)
+			go func() {
+				conn, err := CVLAN.NewServer(&CVLAN.ServerCfg{Context: context.Background(), Conn: wrap(b)})
+				if err != nil {
+					t.Error(err)
+				}
+				serverCh <- conn
+			}()
+
+			client, err := CVLAN.NewClient(&CVLAN.ClientCfg{Context: context.Background(), Conn: wrap(a)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			server := <-serverCh
+			if server == nil {
+				t.FailNow()
+			}
+			defer server.Close()
+
+			go client.Write([]byte("over any transport"))
+			got := make([]byte, 18)
+			if _, err = io.ReadFull(server, got); err != nil || string(got) != "over any transport" {
+				t.Fatalf("got %q, %v", got, err)
+			}
+
+			// pipes are synchronous, close_notify needs a reader
+			go io.Copy(io.Discard, server)
+			client.Close()
+		})
+	}
+}
+
+func TestConn_CloseWrite(t *testing.T) {
+	client, server := newPair(t, false, nil)
+
+	client.Write([]byte("request"))
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("more")); err == nil {
+		t.Fatal("write after CloseWrite succeeded")
+	}
+
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// the other direction is still open
+	server.Write([]byte("response"))
+	server.Close()
+	if got, err = io.ReadAll(client); err != nil || string(got) != "response" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestConn_CloseDuringKeepalive(t *testing.T) {
+	client, server, clientErr, serverErr := handshakePipe(t,
+		&CVLAN.ClientCfg{Keepalive: CVLAN.KeepalivePolicy{Interval: time.Millisecond, MaxMissed: 1000}},
+		&CVLAN.ServerCfg{},
+	)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+
+	// the server doesn't read yet, a keepalive blocks holding the write
+	// lock. Close waits for it instead of skipping close_notify.
+	time.Sleep(20 * time.Millisecond)
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(server)
+		read <- err
+	}()
+	client.Close()
+	if err := <-read; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+}
+
+func TestConn_Truncated(t *testing.T) {
+	a, b := net.Pipe()
+
+	serverCh := make(chan *CVLAN.Conn, 1)
+	go func() {
+		conn, _ := CVLAN.NewServer(&CVLAN.ServerCfg{Context: context.Background(), Conn: b})
+		serverCh <- conn
+	}()
+	client, err := CVLAN.NewClient(&CVLAN.ClientCfg{Context: context.Background(), Conn: a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-serverCh
+	if server == nil {
+		t.FailNow()
+	}
+
+	// the transport ends without close_notify
+	go func() {
+		client.Write([]byte("partial"))
+		a.Close()
+	}()
+
+	got, err := io.ReadAll(server)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || string(got) != "partial" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestConn_RecordTooLarge(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		// a handshake record larger than any hello
+		a.Write([]byte{1, 0, 0, 0x40, 0x01})
+		io.Copy(io.Discard, a)
+	}()
+	_, err := CVLAN.NewServer(&CVLAN.ServerCfg{Context: context.Background(), Conn: b})
+	if err == nil || !strings.Contains(err.Error(), "record too large") {
+		t.Fatalf("server: %v", err)
+	}
+}
+
+func TestConn_Keepalive(t *testing.T) {
+	// a peer is only declared dead after half a second of silence, beats
+	// every 20ms leave plenty of room for scheduling and GC pauses
+	keepalive := CVLAN.KeepalivePolicy{Interval: 20 * time.Millisecond, MaxMissed: 25}
+	client, server := newPair(t, false, func(c *CVLAN.ClientCfg, s *CVLAN.ServerCfg) {
+		c.Keepalive = keepalive
+		s.Keepalive = keepalive
+	})
+
+	// both sides beat, an idle connection stays up for twice as long
+	go io.Copy(io.Discard, client)
+	go io.Copy(io.Discard, server)
+
+	select {
+	case <-server.Context().Done():
+		t.Fatalf("idle peer declared dead: %v", context.Cause(server.Context()))
+	case <-client.Context().Done():
+		t.Fatalf("idle peer declared dead: %v", context.Cause(client.Context()))
+	case <-time.After(2 * time.Duration(keepalive.MaxMissed) * keepalive.Interval):
+	}
+}
+
+func TestConn_PeerDead(t *testing.T) {
+	// the client never sends a keepalive, to the server it looks dead
+	_, server := newPair(t, false, func(_ *CVLAN.ClientCfg, s *CVLAN.ServerCfg) {
+		s.Keepalive = CVLAN.KeepalivePolicy{Interval: 20 * time.Millisecond}
+	})
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	select {
+	case <-server.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("dead peer not detected")
+	}
+	if cause := context.Cause(server.Context()); !errors.Is(cause, CVLAN.ErrPeerDead) {
+		t.Fatalf("unexpected cause: %v", cause)
+	}
+	if err := <-readErr; !errors.Is(err, CVLAN.ErrPeerDead) {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+}
+
+// handshakePipe runs both handshakes over net.Pipe and returns their results.
+func handshakePipe(t *testing.T, clientCfg *CVLAN.ClientCfg, serverCfg *CVLAN.ServerCfg) (client, server *CVLAN.Conn, clientErr, serverErr error) {
+	t.Helper()
+	a, b := net.Pipe()
+	clientCfg.Context, clientCfg.Conn = context.Background(), a
+	serverCfg.Context, serverCfg.Conn = context.Background(), b
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server, serverErr = CVLAN.NewServer(serverCfg)
+	}()
+	client, clientErr = CVLAN.NewClient(clientCfg)
+	if clientErr != nil {
+		a.Close()
+	}
+	<-done
+	if serverErr != nil {
+		b.Close()
+	}
+
+	t.Cleanup(func() {
+		// pipes are synchronous, close_notify needs a reader
+		if server != nil {
+			go io.Copy(io.Discard, server)
+		}
+		if client != nil {
+			client.Close()
+		}
+		if server != nil {
+			server.Close()
+		}
+	})
+	return
+}
+
+func TestConn_Identity(t *testing.T) {
+	serverKey, _ := crypto.GeneratePriKey()
+	clientKey, _ := crypto.GeneratePriKey()
+	pinned := func(want *crypto.PriKey) func(*crypto.PubKey) error {
+		return func(peer *crypto.PubKey) error {
+			if *peer != *want.Public() {
+				return errors.New("unknown peer")
+			}
+			return nil
+		}
+	}
+
+	client, server, clientErr, serverErr := handshakePipe(t,
+		&CVLAN.ClientCfg{Identity: clientKey, VerifyPeer: pinned(serverKey)},
+		&CVLAN.ServerCfg{Identity: serverKey, VerifyPeer: pinned(clientKey)},
+	)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	if *client.PeerPublicKey() != *serverKey.Public() || *server.PeerPublicKey() != *clientKey.Public() {
+		t.Fatal("peer keys don't match the identities")
+	}
+
+	// someone else answering for the server is turned away
+	otherKey, _ := crypto.GeneratePriKey()
+	_, _, clientErr, _ = handshakePipe(t,
+		&CVLAN.ClientCfg{Identity: clientKey, VerifyPeer: pinned(serverKey)},
+		&CVLAN.ServerCfg{Identity: otherKey},
+	)
+	if clientErr == nil || clientErr.Error() != "unknown peer" {
+		t.Fatalf("impostor accepted: %v", clientErr)
+	}
+}
+
+func TestConn_PSK(t *testing.T) {
+	psk := []byte("network secret distributed out of band")
+
+	_, _, clientErr, serverErr := handshakePipe(t, &CVLAN.ClientCfg{PSK: psk}, &CVLAN.ServerCfg{PSK: psk})
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+
+	_, _, clientErr, serverErr = handshakePipe(t, &CVLAN.ClientCfg{PSK: []byte("guessed")}, &CVLAN.ServerCfg{PSK: psk})
+	if !errors.Is(clientErr, CVLAN.ErrPSKMismatch) {
+		t.Fatalf("client: %v", clientErr)
+	}
+	// the server learns of the mismatch from the client's alert
+	if !errors.Is(serverErr, CVLAN.ErrPSKMismatch) {
+		t.Fatalf("server: %v", serverErr)
+	}
+
+	_, _, _, serverErr = handshakePipe(t, &CVLAN.ClientCfg{}, &CVLAN.ServerCfg{PSK: psk})
+	if !errors.Is(serverErr, CVLAN.ErrPSKMismatch) {
+		t.Fatalf("server accepted a client without key: %v", serverErr)
+	}
+	_, _, clientErr, _ = handshakePipe(t, &CVLAN.ClientCfg{PSK: psk}, &CVLAN.ServerCfg{})
+	if !errors.Is(clientErr, CVLAN.ErrPSKMismatch) {
+		t.Fatalf("client: %v", clientErr)
+	}
+}
+
+func TestConn_ExportKeyingMaterial(t *testing.T) {
+	client, server := newPair(t, false, nil)
+
+	a, err := client.ExportKeyingMaterial("channel binding", []byte("ctx"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := server.ExportKeyingMaterial("channel binding", []byte("ctx"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Fatal("both ends export different material")
+	}
+
+	other, _ := client.ExportKeyingMaterial("channel binding", []byte("other"), 32)
+	if bytes.Equal(a, other) {
+		t.Fatal("context is not bound into the material")
+	}
+
+	// another connection exports other material
+	client2, _ := newPair(t, false, nil)
+	c, _ := client2.ExportKeyingMaterial("channel binding", []byte("ctx"), 32)
+	if bytes.Equal(a, c) {
+		t.Fatal("material is not bound to the connection")
+	}
+
+	if _, err := client.ExportKeyingMaterial("channel binding", nil, -1); err == nil {
+		t.Fatal("negative length accepted")
+	}
+	if _, err := client.ExportKeyingMaterial("channel binding", make([]byte, 0xffff), 32); err == nil {
+		t.Fatal("oversized context accepted")
+	}
+	if _, err := client.ExportKeyingMaterial("channel binding", make([]byte, 0x1000), 32); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConn_Negotiation(t *testing.T) {
+	client, server, clientErr, serverErr := handshakePipe(t, &CVLAN.ClientCfg{}, &CVLAN.ServerCfg{})
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	for _, c := range []*CVLAN.Conn{client, server} {
+		if kex, cipher := c.Suite(); kex != CVLAN.X25519 || cipher != CVLAN.AES256GCM {
+			t.Fatalf("negotiated %s, %s", kex, cipher)
+		}
+	}
+
+	if _, err := CVLAN.NewClient(&CVLAN.ClientCfg{Context: context.Background(), Ciphers: []CVLAN.Cipher{99}}); err == nil {
+		t.Fatal("unknown cipher offered")
+	}
+
+	// a client of a future version is told so
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		hello := []byte{CVLAN.ProtocolVersion + 1, 1, byte(CVLAN.X25519), 1, byte(CVLAN.AES256GCM), 0, 0}
+		a.Write(append([]byte{1, 0, 0, 0, byte(len(hello))}, hello...))
+	}()
+	_, err := CVLAN.NewServer(&CVLAN.ServerCfg{Context: context.Background(), Conn: b})
+	if !errors.Is(err, CVLAN.ErrUnsupportedVersion) {
+		t.Fatalf("server: %v", err)
+	}
+}
+
+func TestConn_Steps(t *testing.T) {
+	assigned := CVLAN.NewStateKey[string]("assigned ip")
+
+	// the server hands out an address, the client takes it
+	serverStep := func(conn *CVLAN.Conn) CVLAN.HandShake {
+		return CVLAN.HandShakeFunc(func() error {
+			CVLAN.SetState(conn, assigned, "10.0.0.2")
+			return conn.WriteEncrypted([]byte("10.0.0.2"))
+		})
+	}
+	clientStep := func(conn *CVLAN.Conn) CVLAN.HandShake {
+		return CVLAN.HandShakeFunc(func() error {
+			ip, err := conn.ReadEncrypted()
+			if err != nil {
+				return err
+			}
+			CVLAN.SetState(conn, assigned, string(ip))
+			return nil
+		})
+	}
+	// a later step sees what an earlier one left
+	checkStep := func(conn *CVLAN.Conn) CVLAN.HandShake {
+		return CVLAN.HandShakeFunc(func() error {
+			if _, ok := CVLAN.GetState(conn, assigned); !ok {
+				return errors.New("no address assigned")
+			}
+			return nil
+		})
+	}
+
+	client, server, clientErr, serverErr := handshakePipe(t,
+		&CVLAN.ClientCfg{Steps: []func(*CVLAN.Conn) CVLAN.HandShake{clientStep, checkStep}},
+		&CVLAN.ServerCfg{Steps: []func(*CVLAN.Conn) CVLAN.HandShake{serverStep, checkStep}},
+	)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	for _, c := range []*CVLAN.Conn{client, server} {
+		if ip, _ := CVLAN.GetState(c, assigned); ip != "10.0.0.2" {
+			t.Fatalf("assigned %q", ip)
+		}
+	}
+	if err := client.WriteEncrypted([]byte("late")); err == nil {
+		t.Fatal("handshake message after the handshake")
+	}
+
+	// a failing step fails the handshake
+	reject := func(*CVLAN.Conn) CVLAN.HandShake {
+		return CVLAN.HandShakeFunc(func() error { return errors.New("rejected") })
+	}
+	_, _, _, serverErr = handshakePipe(t, &CVLAN.ClientCfg{}, &CVLAN.ServerCfg{Steps: []func(*CVLAN.Conn) CVLAN.HandShake{reject}})
+	if serverErr == nil || serverErr.Error() != "rejected" {
+		t.Fatalf("server: %v", serverErr)
+	}
+}
+
+func TestConn_TranscriptTampered(t *testing.T) {
+	a, mitmA := net.Pipe()
+	mitmB, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// flip a bit of the client's key share, the rest is relayed as is
+	go func() {
+		defer mitmB.Close()
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(mitmA, header); err != nil {
+			return
+		}
+		hello := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(mitmA, hello); err != nil {
+			return
+		}
+		// version, one key exchange, one cipher, share length
+		hello[7] ^= 1
+		mitmB.Write(append(header, hello...))
+		io.Copy(mitmB, mitmA)
+	}()
+	go func() {
+		defer mitmA.Close()
+		io.Copy(mitmA, mitmB)
+	}()
+
+	go CVLAN.NewServer(&CVLAN.ServerCfg{Context: context.Background(), Conn: b})
+	_, err := CVLAN.NewClient(&CVLAN.ClientCfg{Context: context.Background(), Conn: a})
+	if !errors.Is(err, CVLAN.ErrTranscriptMismatch) || !strings.HasPrefix(err.Error(), "client detected") {
+		t.Fatalf("client: %v", err)
+	}
+}
+
+func TestConn_Resumption(t *testing.T) {
+	serverKey, _ := crypto.GeneratePriKey()
+	clientKey, _ := crypto.GeneratePriKey()
+	tickets, err := CVLAN.NewTicketKeys(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _, clientErr, serverErr := handshakePipe(t, &CVLAN.ClientCfg{Identity: clientKey}, &CVLAN.ServerCfg{Identity: serverKey, Tickets: tickets})
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	ticket := first.Ticket()
+	if ticket == nil || first.Resumed() {
+		t.Fatal("no ticket issued")
+	}
+
+	// a stored ticket resumes as well
+	b, _ := ticket.MarshalBinary()
+	stored := new(CVLAN.Ticket)
+	if err = stored.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// tickets sealed before a rotation are still accepted
+	tickets.Rotate()
+
+	client, server, clientErr, serverErr := handshakePipe(t, &CVLAN.ClientCfg{Ticket: stored}, &CVLAN.ServerCfg{Identity: serverKey, Tickets: tickets})
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	if !client.Resumed() || !server.Resumed() {
+		t.Fatal("session not resumed")
+	}
+	if *client.PeerPublicKey() != *serverKey.Public() || *server.PeerPublicKey() != *clientKey.Public() {
+		t.Fatal("resumed session lost the peers' keys")
+	}
+	a, _ := first.ExportKeyingMaterial("test", nil, 32)
+	c, _ := client.ExportKeyingMaterial("test", nil, 32)
+	if bytes.Equal(a, c) {
+		t.Fatal("resumed session reuses keys")
+	}
+	if client.Ticket() == nil {
+		t.Fatal("no new ticket issued")
+	}
+
+	go client.Write([]byte("resumed"))
+	buf := make([]byte, 7)
+	if _, err = io.ReadFull(server, buf); err != nil || string(buf) != "resumed" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+
+	// a server without the ticket's key falls back to a full handshake
+	other, _ := CVLAN.NewTicketKeys(time.Hour)
+	client, _, clientErr, serverErr = handshakePipe(t, &CVLAN.ClientCfg{Ticket: ticket}, &CVLAN.ServerCfg{Identity: serverKey, Tickets: other})
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	if client.Resumed() {
+		t.Fatal("resumed with an unknown ticket key")
+	}
+
+	// keys shared with SetKeys survive a rotation for a lifetime, even when
+	// they didn't seal
+	var k1, k2 [32]byte
+	k1[0], k2[0] = 1, 2
+	shared := &CVLAN.TicketKeys{Lifetime: time.Hour}
+	shared.SetKeys(k2)
+	first, _, clientErr, serverErr = handshakePipe(t, &CVLAN.ClientCfg{}, &CVLAN.ServerCfg{Tickets: shared})
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	shared.SetKeys(k1, k2)
+	shared.Rotate()
+	client, _, clientErr, serverErr = handshakePipe(t, &CVLAN.ClientCfg{Ticket: first.Ticket()}, &CVLAN.ServerCfg{Tickets: shared})
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	if !client.Resumed() {
+		t.Fatal("ticket of a shared key rejected after a rotation")
+	}
+
+	// a ticket without a static key can't be resumed once either side
+	// verifies peers
+	psk := []byte("network secret distributed out of band")
+	nist := []CVLAN.KeyExchange{CVLAN.P256}
+	first, _, clientErr, serverErr = handshakePipe(t,
+		&CVLAN.ClientCfg{KeyExchanges: nist, PSK: psk},
+		&CVLAN.ServerCfg{KeyExchanges: nist, PSK: psk, Tickets: tickets},
+	)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	deny := func(*crypto.PubKey) error { return errors.New("denied") }
+	for name, verify := range map[string][2]func(*crypto.PubKey) error{
+		"client": {deny, nil},
+		"server": {nil, deny},
+		"both":   {deny, deny},
+	} {
+		client, _, clientErr, serverErr = handshakePipe(t,
+			&CVLAN.ClientCfg{KeyExchanges: nist, PSK: psk, Ticket: first.Ticket(), VerifyPeer: verify[0]},
+			&CVLAN.ServerCfg{KeyExchanges: nist, PSK: psk, Tickets: tickets, VerifyPeer: verify[1]},
+		)
+		if clientErr == nil || serverErr == nil || (client != nil && client.Resumed()) {
+			t.Fatalf("%s: resumed a ticket without a peer key: %v, %v", name, clientErr, serverErr)
+		}
+	}
+
+	if _, err = CVLAN.NewServer(&CVLAN.ServerCfg{Context: context.Background(), Tickets: &CVLAN.TicketKeys{}}); err == nil {
+		t.Fatal("ticket keys without a key accepted")
+	}
+}
+
+func TestConn_Authorize(t *testing.T) {
+	auth := &CVLAN.HMACAuthorizer{Key: []byte("issuer key")}
+	token, err := auth.Issue(&CVLAN.Claims{Subject: "laptop-7", Expires: time.Now().Add(time.Hour), Extra: map[string]string{"net": "office"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the token only goes to an authenticated server
+	if _, err = CVLAN.NewClient(&CVLAN.ClientCfg{Context: context.Background(), Token: token}); err == nil {
+		t.Fatal("token sent to an anonymous server")
+	}
+
+	psk := []byte("network secret distributed out of band")
+	client, server, clientErr, serverErr := handshakePipe(t, &CVLAN.ClientCfg{Token: token, PSK: psk}, &CVLAN.ServerCfg{Authorizer: auth, PSK: psk})
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	if claims := server.Claims(); claims == nil || claims.Subject != "laptop-7" || claims.Extra["net"] != "office" {
+		t.Fatalf("claims %+v", claims)
+	}
+	if client.Claims() != nil {
+		t.Fatal("client has claims")
+	}
+
+	forged, _ := (&CVLAN.HMACAuthorizer{Key: []byte("guessed")}).Issue(&CVLAN.Claims{Subject: "laptop-7", Expires: time.Now().Add(time.Hour)})
+	expired, _ := auth.Issue(&CVLAN.Claims{Subject: "laptop-7", Expires: time.Now().Add(-time.Minute)})
+	for name, token := range map[string][]byte{"none": nil, "forged": forged, "expired": expired} {
+		_, _, clientErr, serverErr = handshakePipe(t, &CVLAN.ClientCfg{Token: token, PSK: psk}, &CVLAN.ServerCfg{Authorizer: auth, PSK: psk})
+		if !errors.Is(clientErr, CVLAN.AlertAuthFailed) || !errors.Is(serverErr, CVLAN.ErrUnauthorized) {
+			t.Fatalf("%s: %v, %v", name, clientErr, serverErr)
+		}
+	}
+}
+
+// issue signs an Ed25519 certificate for name with parent, a self-signed CA
+// when parent is nil.
+func issue(t *testing.T, name string, usage x509.ExtKeyUsage, notAfter time.Time, parent *CVLAN.Certificate) *CVLAN.Certificate {
+	t.Helper()
+	pub, key, _ := ed25519.GenerateKey(nil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	signer, parentCert := key, tmpl
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{name}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		signer = parent.Key
+		parentCert, _ = x509.ParseCertificate(parent.Chain[0])
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, pub, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CVLAN.Certificate{Chain: [][]byte{der}, Key: key}
+}
+
+func TestConn_Certificate(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	ca := issue(t, "cvlan ca", 0, later, nil)
+	roots := x509.NewCertPool()
+	caCert, _ := x509.ParseCertificate(ca.Chain[0])
+	roots.AddCert(caCert)
+
+	serverCert := issue(t, "vpn.example", x509.ExtKeyUsageServerAuth, later, ca)
+	clientCert := issue(t, "laptop-7", x509.ExtKeyUsageClientAuth, later, ca)
+
+	client, server, clientErr, serverErr := handshakePipe(t,
+		&CVLAN.ClientCfg{Certificate: clientCert, Roots: roots, ServerName: "vpn.example"},
+		&CVLAN.ServerCfg{Certificate: serverCert, Roots: roots},
+	)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	if certs := client.PeerCertificates(); len(certs) != 2 || certs[0].Subject.CommonName != "vpn.example" {
+		t.Fatalf("client sees %v", certs)
+	}
+	if certs := server.PeerCertificates(); len(certs) != 2 || certs[0].Subject.CommonName != "laptop-7" {
+		t.Fatalf("server sees %v", certs)
+	}
+
+	// the server's name must be checked and the key usable
+	if _, err := CVLAN.NewClient(&CVLAN.ClientCfg{Context: context.Background(), Roots: roots}); err == nil {
+		t.Fatal("roots without a server name accepted")
+	}
+	if _, err := CVLAN.NewServer(&CVLAN.ServerCfg{Context: context.Background(), Certificate: &CVLAN.Certificate{Chain: serverCert.Chain}}); err == nil {
+		t.Fatal("certificate without a key accepted")
+	}
+
+	otherCA := issue(t, "other ca", 0, later, nil)
+	for name, c := range map[string]struct {
+		client *CVLAN.ClientCfg
+		server *CVLAN.ServerCfg
+	}{
+		"wrong name": {
+			&CVLAN.ClientCfg{Roots: roots, ServerName: "db.example"},
+			&CVLAN.ServerCfg{Certificate: serverCert},
+		},
+		"expired": {
+			&CVLAN.ClientCfg{Roots: roots, ServerName: "vpn.example"},
+			&CVLAN.ServerCfg{Certificate: issue(t, "vpn.example", x509.ExtKeyUsageServerAuth, time.Now().Add(-time.Minute), ca)},
+		},
+		"unknown ca": {
+			&CVLAN.ClientCfg{Roots: roots, ServerName: "vpn.example"},
+			&CVLAN.ServerCfg{Certificate: issue(t, "vpn.example", x509.ExtKeyUsageServerAuth, later, otherCA)},
+		},
+		"client cert as server": {
+			&CVLAN.ClientCfg{Roots: roots, ServerName: "laptop-7"},
+			&CVLAN.ServerCfg{Certificate: clientCert},
+		},
+	} {
+		_, _, clientErr, _ = handshakePipe(t, c.client, c.server)
+		if !errors.Is(clientErr, CVLAN.ErrBadCertificate) {
+			t.Fatalf("%s: %v", name, clientErr)
+		}
+	}
+
+	// a server with roots refuses clients without a certificate
+	_, _, _, serverErr = handshakePipe(t, &CVLAN.ClientCfg{}, &CVLAN.ServerCfg{Certificate: serverCert, Roots: roots})
+	if !errors.Is(serverErr, CVLAN.ErrBadCertificate) {
+		t.Fatalf("server: %v", serverErr)
+	}
+}
+
+func TestConn_HandshakeAlert(t *testing.T) {
+	psk := []byte("network secret distributed out of band")
+
+	// the client can't read the server's static key and tells it why
+	_, _, clientErr, serverErr := handshakePipe(t, &CVLAN.ClientCfg{}, &CVLAN.ServerCfg{PSK: psk})
+	if !errors.Is(clientErr, CVLAN.AlertDecryptError) || !errors.Is(clientErr, CVLAN.ErrTranscriptMismatch) {
+		t.Fatalf("client: %v", clientErr)
+	}
+	var alertErr *CVLAN.AlertError
+	if !errors.As(serverErr, &alertErr) || !alertErr.Remote || alertErr.Alert != CVLAN.AlertDecryptError {
+		t.Fatalf("server: %v", serverErr)
+	}
+
+	// a step picks its own alert
+	refuse := func(*CVLAN.Conn) CVLAN.HandShake {
+		return CVLAN.HandShakeFunc(func() error {
+			return &CVLAN.AlertError{Alert: CVLAN.AlertAuthFailed, Err: errors.New("address pool exhausted")}
+		})
+	}
+	_, _, clientErr, _ = handshakePipe(t,
+		&CVLAN.ClientCfg{Steps: []func(*CVLAN.Conn) CVLAN.HandShake{func(conn *CVLAN.Conn) CVLAN.HandShake {
+			return CVLAN.HandShakeFunc(func() error { _, err := conn.ReadEncrypted(); return err })
+		}}},
+		&CVLAN.ServerCfg{Steps: []func(*CVLAN.Conn) CVLAN.HandShake{refuse}},
+	)
+	if !errors.Is(clientErr, CVLAN.AlertAuthFailed) {
+		t.Fatalf("client: %v", clientErr)
+	}
+
+	// a client of a future version gets bad version
+	a, b := net.Pipe()
+	defer a.Close()
+	go CVLAN.NewServer(&CVLAN.ServerCfg{Context: context.Background(), Conn: b})
+	hello := []byte{CVLAN.ProtocolVersion + 1}
+	a.Write(append([]byte{1, 0, 0, 0, byte(len(hello))}, hello...))
+	reply := make([]byte, 6)
+	if _, err := io.ReadFull(a, reply); err != nil || reply[0] != 4 || CVLAN.Alert(reply[5]) != CVLAN.AlertBadVersion {
+		t.Fatalf("got %v, %v", reply, err)
+	}
+}
+
+func TestConn_HybridKeyExchange(t *testing.T) {
+	serverKey, _ := crypto.GeneratePriKey()
+	client, server := newPair(t, false, func(c *CVLAN.ClientCfg, s *CVLAN.ServerCfg) {
+		c.KeyExchanges = []CVLAN.KeyExchange{CVLAN.X25519MLKEM768, CVLAN.X25519}
+		c.VerifyPeer = func(peer *crypto.PubKey) error {
+			if *peer != *serverKey.Public() {
+				return errors.New("unknown peer")
+			}
+			return nil
+		}
+		c.Rekey = CVLAN.RekeyPolicy{Records: 2}
+		s.KeyExchanges = []CVLAN.KeyExchange{CVLAN.X25519, CVLAN.X25519MLKEM768}
+		s.Identity = serverKey
+	})
+	// the client's preference wins
+	if kex, _ := server.Suite(); kex != CVLAN.X25519MLKEM768 {
+		t.Fatalf("negotiated %s", kex)
+	}
+
+	// the hybrid session rekeys like any other
+	secret := append([]byte(nil), CVLAN.TrafficSecret(client)...)
+	go io.Copy(server, server)
+	for i := 0; i < 8; i++ {
+		if _, err := client.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 1)
+		if _, err := io.ReadFull(client, got); err != nil || got[0] != byte(i) {
+			t.Fatalf("got %v, %v", got, err)
+		}
+	}
+	if bytes.Equal(secret, CVLAN.TrafficSecret(client)) {
+		t.Fatal("session was never rekeyed")
+	}
+
+	// a server without it falls back to X25519
+	_, server2, clientErr, serverErr := handshakePipe(t,
+		&CVLAN.ClientCfg{KeyExchanges: []CVLAN.KeyExchange{CVLAN.X25519MLKEM768, CVLAN.X25519}},
+		&CVLAN.ServerCfg{},
+	)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	if kex, _ := server2.Suite(); kex != CVLAN.X25519 {
+		t.Fatalf("negotiated %s", kex)
+	}
+}
+
+func TestConn_NISTCurves(t *testing.T) {
+	psk := []byte("network secret distributed out of band")
+	for _, kex := range []CVLAN.KeyExchange{CVLAN.P256, CVLAN.P384, CVLAN.P521} {
+		client, server, clientErr, serverErr := handshakePipe(t,
+			&CVLAN.ClientCfg{KeyExchanges: []CVLAN.KeyExchange{kex}, PSK: psk},
+			&CVLAN.ServerCfg{KeyExchanges: []CVLAN.KeyExchange{CVLAN.P521, CVLAN.P384, CVLAN.P256}, PSK: psk},
+		)
+		if clientErr != nil || serverErr != nil {
+			t.Fatal(kex, clientErr, serverErr)
+		}
+		if got, _ := server.Suite(); got != kex {
+			t.Fatalf("negotiated %s, want %s", got, kex)
+		}
+		if client.PeerPublicKey() != nil {
+			t.Fatal("static key without Curve25519")
+		}
+
+		go client.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("%s: got %q, %v", kex, buf, err)
+		}
+	}
+
+	// static keys can't be mixed with a NIST curve exchange
+	serverKey, _ := crypto.GeneratePriKey()
+	_, _, _, serverErr := handshakePipe(t,
+		&CVLAN.ClientCfg{KeyExchanges: []CVLAN.KeyExchange{CVLAN.P256}},
+		&CVLAN.ServerCfg{KeyExchanges: []CVLAN.KeyExchange{CVLAN.P256}, Identity: serverKey},
+	)
+	if !errors.Is(serverErr, CVLAN.ErrNoCommonSuite) {
+		t.Fatalf("server: %v", serverErr)
+	}
+}
+
+func TestConn_Cookie(t *testing.T) {
+	cookies := &CVLAN.CookiePolicy{Key: []byte("cookie key")}
+	_, _, clientErr, serverErr := handshakePipe(t, &CVLAN.ClientCfg{}, &CVLAN.ServerCfg{Cookies: cookies})
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+
+	// a flood client that doesn't echo the cookie gets no key exchange
+	a, b := net.Pipe()
+	defer a.Close()
+	serverErrCh := make(chan error, 1)
+	go func() {
+		_, err := CVLAN.NewServer(&CVLAN.ServerCfg{Context: context.Background(), Conn: b, Cookies: cookies})
+		serverErrCh <- err
+	}()
+	hello := append([]byte{CVLAN.ProtocolVersion, 1, byte(CVLAN.X25519), 1, byte(CVLAN.AES256GCM), 0, 32}, make([]byte, 32+4)...)
+	record := append([]byte{1, 0, 0, 0, byte(len(hello))}, hello...)
+	a.Write(record)
+
+	header := make([]byte, 5)
+	io.ReadFull(a, header)
+	reply := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	io.ReadFull(a, reply)
+	if reply[1] != 0 || reply[3] != 2 {
+		t.Fatalf("no cookie request: %v", reply)
+	}
+
+	go io.Copy(io.Discard, a)
+	a.Write(record)
+	if err := <-serverErrCh; !errors.Is(err, CVLAN.ErrBadCookie) {
+		t.Fatalf("server: %v", err)
+	}
+}
+
+func TestConn_KnownPeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+	serverKey, _ := crypto.GeneratePriKey()
+
+	connect := func(key *crypto.PriKey) (*CVLAN.Conn, error) {
+		known, err := CVLAN.OpenKnownPeers(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, _, clientErr, _ := handshakePipe(t,
+			&CVLAN.ClientCfg{KnownPeers: known, ServerName: "vpn.example"},
+			&CVLAN.ServerCfg{Identity: key},
+		)
+		return client, clientErr
+	}
+
+	// first use records the key, later ones check it
+	for i := 0; i < 2; i++ {
+		if _, err := connect(serverKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	known, _ := CVLAN.OpenKnownPeers(path)
+	if pub, _ := known.Lookup("vpn.example"); pub == nil || *pub != *serverKey.Public() {
+		t.Fatalf("recorded %v", pub)
+	}
+
+	otherKey, _ := crypto.GeneratePriKey()
+	if _, err := connect(otherKey); !errors.Is(err, CVLAN.ErrPeerKeyChanged) || !errors.Is(err, CVLAN.AlertAuthFailed) {
+		t.Fatalf("changed key accepted: %v", err)
+	}
+}
+
+func TestConn_ChaCha20Poly1305(t *testing.T) {
+	for _, cipher := range []CVLAN.Cipher{CVLAN.ChaCha20Poly1305, CVLAN.XChaCha20Poly1305} {
+		client, server := newPair(t, false, func(c *CVLAN.ClientCfg, s *CVLAN.ServerCfg) {
+			c.Ciphers = []CVLAN.Cipher{cipher, CVLAN.AES256GCM}
+			c.Rekey = CVLAN.RekeyPolicy{Records: 1}
+			s.Ciphers = []CVLAN.Cipher{CVLAN.AES256GCM, CVLAN.ChaCha20Poly1305, CVLAN.XChaCha20Poly1305}
+		})
+		if _, got := server.Suite(); got != cipher {
+			t.Fatalf("negotiated %s, want %s", got, cipher)
+		}
+
+		// rekeying keeps the negotiated cipher
+		go io.Copy(server, server)
+		go func() {
+			client.Write([]byte("hello"))
+			client.Write([]byte("again"))
+		}()
+		buf := make([]byte, 10)
+		if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "helloagain" {
+			t.Fatalf("%s: got %q, %v", cipher, buf, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package CVLAN
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// RetryPolicy sets how often and how fast a Dialer tries again after a
+// failed connect or handshake.
+type RetryPolicy struct {
+	// Attempts is the total number of tries, values below 2 disable retries.
+	Attempts int
+	// Backoff is the wait before the second try, every further wait grows
+	// by Multiplier up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Multiplier defaults to 2.
+	Multiplier float64
+}
+
+func (p RetryPolicy) wait(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	wait := float64(p.Backoff)
+	for i := 1; i < attempt; i++ {
+		wait *= multiplier
+		if p.MaxBackoff > 0 && wait >= float64(p.MaxBackoff) {
+			return p.MaxBackoff
+		}
+	}
+	return time.Duration(wait)
+}
+
+// Dialer connects to a server and runs the client handshake. Its DialContext
+// fits http.Transport.DialContext.
+type Dialer struct {
+	// Client is the template every connection is set up with, its Conn
+	// field is ignored. The context of the dial only bounds connecting and
+	// the handshake, the connection itself lives on Client.Context.
+	Client *ClientCfg
+	// HandshakeTimeout bounds connecting plus the handshake of one try.
+	HandshakeTimeout time.Duration
+	Retry            RetryPolicy
+
+	// NetDialer connects the transport, the zero value is used when nil.
+	NetDialer *net.Dialer
+}
+
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.DialConn(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialConn is DialContext returning the established *Conn.
+// Config errors and handshakes the server refused or failed to
+// authenticate are not retried.
+func (d *Dialer) DialConn(ctx context.Context, network, addr string) (*Conn, error) {
+	if d.Client != nil {
+		if _, _, err := d.Client.check(); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var conn *Conn
+		if conn, err = d.dial(ctx, network, addr); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil || attempt >= d.Retry.Attempts || !retryable(err) {
+			return nil, err
+		}
+
+		timer := time.NewTimer(d.Retry.wait(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (d *Dialer) dial(ctx context.Context, network, addr string) (*Conn, error) {
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+
+	netDialer := d.NetDialer
+	if netDialer == nil {
+		netDialer = &net.Dialer{}
+	}
+	rawConn, err := netDialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := ClientCfg{}
+	if d.Client != nil {
+		cfg = *d.Client
+	}
+	if cfg.Context == nil {
+		cfg.Context = context.Background()
+	}
+	cfg.Conn = rawConn
+
+	stop := watchHandshake(ctx, rawConn)
+	conn, err := NewClient(&cfg)
+	if cerr := stop(); cerr != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		err = cerr
+	}
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// retryable reports whether another try may succeed. A handshake that failed
+// with an alert, sent or received, fails again the same way, except on an
+// internal error.
+func retryable(err error) bool {
+	var alertErr *AlertError
+	return !errors.As(err, &alertErr) || alertErr.Alert == AlertInternalError
+}
@@ -0,0 +1,98 @@
+package CVLAN_test
+
+import (
+	"context"
+	"errors"
+	CVLAN "github.com/cvlan/core"
+	"github.com/cvlan/core/crypto"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDialer_DialContext(t *testing.T) {
+	listener, err := CVLAN.Listen("127.0.0.1:0", &CVLAN.ListenerCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	dialer := &CVLAN.Dialer{HandshakeTimeout: 5 * time.Second}
+	conn, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("echo"))
+	got := make([]byte, 4)
+	if _, err = io.ReadFull(conn, got); err != nil || string(got) != "echo" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestDialer_Cancel(t *testing.T) {
+	// a plain TCP server that never answers the client hello
+	tcpListener, err := CVLAN.NewTCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dialer := &CVLAN.Dialer{
+		Retry: CVLAN.RetryPolicy{Attempts: 5, Backoff: 10 * time.Millisecond},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err = dialer.DialContext(ctx, "tcp", tcpListener.Addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial aborted after %s", elapsed)
+	}
+}
+
+func TestDialer_NoRetryOnRefusal(t *testing.T) {
+	listener, err := CVLAN.Listen("127.0.0.1:0", &CVLAN.ListenerCfg{
+		Server: &CVLAN.ServerCfg{VerifyPeer: func(*crypto.PubKey) error { return errors.New("denied") }},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	retry := CVLAN.RetryPolicy{Attempts: 5, Backoff: time.Second}
+	for name, client := range map[string]*CVLAN.ClientCfg{
+		"refused":        nil,
+		"unknown cipher": {Ciphers: []CVLAN.Cipher{99}},
+	} {
+		start := time.Now()
+		_, err := (&CVLAN.Dialer{Client: client, Retry: retry}).Dial("tcp", listener.Addr().String())
+		if err == nil {
+			t.Fatalf("%s: dial succeeded", name)
+		}
+		if elapsed := time.Since(start); elapsed > retry.Backoff/2 {
+			t.Fatalf("%s: retried for %s: %v", name, elapsed, err)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package CVLAN
+
+// TrafficSecret exposes the current sending traffic secret to tests.
+func TrafficSecret(c *Conn) []byte {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.keys.sendSecret
+}
@@ -1,5 +1,8 @@
 module github.com/cvlan/core
 
-go 1.20
+// go 1.24 for crypto/mlkem, used by the X25519MLKEM768 key exchange
+go 1.24
 
 require golang.org/x/crypto v0.6.0
+
+require golang.org/x/sys v0.5.0 // indirect
@@ -1,158 +1,483 @@
 package CVLAN
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"github.com/cvlan/core/crypto"
-	"github.com/cvlan/core/util"
+	"time"
 )
 
 type HandShake interface {
 	Do() error
 }
 
+// HandShakeFunc adapts a function to a HandShake step.
+type HandShakeFunc func() error
+
+func (f HandShakeFunc) Do() error { return f() }
+
+// handshakeState is shared between the handshake steps of a connection and
+// dropped once the handshake is done.
+type handshakeState struct {
+	ephemeral     crypto.ECDH[crypto.PubKey]
+	peerEphemeral *crypto.PubKey
+
+	identity   *crypto.PriKey
+	anonymous  bool
+	verifyPeer func(peer *crypto.PubKey) error
+
+	psk []byte
+
+	// suites of this side in preference order
+	kexs    []KeyExchange
+	ciphers []Cipher
+
+	// the client's ticket to offer, the server's keys to open it with
+	ticket  *Ticket
+	tickets *TicketKeys
+
+	// this side's certificate, the roots to verify the peer's against and
+	// the name the server's has to be valid for
+	certificate *Certificate
+	roots       *x509.CertPool
+	serverName  string
+
+	// the client's pinned server keys and the name they are pinned under
+	knownPeers KnownPeers
+	peerName   string
+
+	// asks clients for a cookie before the key exchange
+	cookies *CookiePolicy
+
+	// the client's token, the server's judge of it
+	token      []byte
+	authorizer Authorizer
+}
+
+// ErrPSKMismatch is returned by the handshake when a pre-shared key is
+// configured and the peer's messages don't decrypt with it, which means the
+// peer holds another key or none.
+var ErrPSKMismatch = errors.New("pre-shared key mismatch")
+
+func newHandshakeState(identity *crypto.PriKey, verifyPeer func(*crypto.PubKey) error) (*handshakeState, error) {
+	hs := &handshakeState{identity: identity, verifyPeer: verifyPeer}
+	if identity == nil {
+		// anonymous, only good for this connection
+		var err error
+		if hs.identity, err = crypto.GeneratePriKey(); err != nil {
+			return nil, err
+		}
+		hs.anonymous = true
+	}
+	return hs, nil
+}
+
+// skipIdentity reports whether the identity step has nothing to do: the
+// session was resumed, or the key exchange has no Curve25519 keys to mix
+// the static ones with. That is only fine when this side neither has nor
+// checks static keys.
+func (c *Conn) skipIdentity() (bool, error) {
+	if c.resumed {
+		return true, nil
+	}
+	if c.hs.ephemeral != nil {
+		return false, nil
+	}
+	if !c.hs.anonymous || c.hs.verifyPeer != nil {
+		return false, fmt.Errorf("%w: static identities need a Curve25519 key exchange, %s was negotiated", ErrNoCommonSuite, c.kex)
+	}
+	return true, nil
+}
+
+// useSuite switches the connection to the negotiated suite.
+func (c *Conn) useSuite(kex any, kexID KeyExchange, cipher Cipher) {
+	if x, ok := kex.(interface {
+		ephemeral() (crypto.ECDH[crypto.PubKey], *crypto.PubKey)
+	}); ok {
+		c.hs.ephemeral, c.hs.peerEphemeral = x.ephemeral()
+	}
+	c.kex, c.cipher = kexID, cipher
+	c.keys.newCipher = ciphers[cipher]
+}
+
+// mixKey chains secret into the key schedule and switches to handshake keys
+// derived from the result, so the keys depend on every exchange so far.
+func (c *Conn) mixKey(secret []byte) (err error) {
+	c.keys.mix(secret)
+	c.crypt, err = c.keys.handshakeCipher()
+	return
+}
+
+var errNoHandshakeKeys = errors.New("no handshake keys outside the handshake")
+
+// WriteEncrypted and ReadEncrypted exchange handshake messages under the
+// current handshake keys. Handshake steps use them once the key exchange is
+// done, the messages are only readable by the peer it was done with.
+func (c *Conn) WriteEncrypted(msg []byte) error {
+	if c.crypt == nil || c.established {
+		return errNoHandshakeKeys
+	}
+	data, err := c.crypt.Encrypt(msg, nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.WriteAsBytes(data)
+	return err
+}
+
+func (c *Conn) ReadEncrypted() ([]byte, error) {
+	if c.crypt == nil || c.established {
+		return nil, errNoHandshakeKeys
+	}
+	bs, err := c.ReadAsBytes()
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.crypt.Decrypt(bs, nil)
+	if err != nil {
+		// the keys differ, either the secrets or the messages they were
+		// derived from
+		if c.hs.psk != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPSKMismatch, err)
+		}
+		return nil, c.transcriptMismatch()
+	}
+	return data, nil
+}
+
+// handshakeWithPSK mixes the pre-shared key into the session secret right
+// after the ephemeral exchange. Everything after it, the static keys
+// included, only decrypts for a peer holding the same key.
+type handshakeWithPSK struct{ *Conn }
+
+func (e *handshakeWithPSK) Do() error {
+	if e.hs.psk == nil {
+		return nil
+	}
+	return e.mixKey(e.hs.psk)
+}
+
+// readIdentity reads the peer's static public key and lets the application
+// judge it.
+func (c *Conn) readIdentity() (*crypto.PubKey, error) {
+	data, err := c.ReadEncrypted()
+	if err != nil {
+		return nil, err
+	}
+	peer, err := c.hs.ephemeral.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if c.hs.verifyPeer != nil {
+		if err = c.hs.verifyPeer(peer); err != nil {
+			return nil, authFailure{err}
+		}
+	}
+	c.peerIdentity = peer
+	return peer, nil
+}
+
 type ServerHandshake struct{}
 
+// serverHandshakeWithECDH reads the client's hello, picks a suite from its
+// offer and answers with the matching key share. A valid ticket in the hello
+// resumes its session without a key exchange.
 type serverHandshakeWithECDH struct{ *Conn }
 
+func (e *serverHandshakeWithECDH) readHello() (*clientHello, error) {
+	bs, err := e.ReadAsBytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) > 0 && bs[0] != ProtocolVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, bs[0])
+	}
+
+	hello := &clientHello{}
+	if err = hello.unmarshal(bs); err != nil {
+		return nil, err
+	}
+	return hello, nil
+}
+
 func (e *serverHandshakeWithECDH) Do() error {
-	// recv alice public key
-	apk, err := e.ReadAsBytes()
+	hello, err := e.readHello()
 	if err != nil {
 		return err
 	}
 
-	if len(apk) != 32 {
-		return errors.New("invalid read size")
+	// nothing expensive happens before the client answered a cookie request
+	ok, err := e.checkCookie(hello, false)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if hello, err = e.readHello(); err != nil {
+			return err
+		}
+		if _, err = e.checkCookie(hello, true); err != nil {
+			return err
+		}
 	}
 
-	ecdh, _ := crypto.NewCurve25519ECDH()
+	if t := e.acceptTicket(hello); t != nil {
+		nonce := make([]byte, resumeNonceSize)
+		if _, err = rand.Read(nonce); err != nil {
+			return err
+		}
+		reply := &serverHello{version: ProtocolVersion, kex: t.kex, cipher: t.cipher, resumed: true, share: nonce}
+		if _, err = e.WriteAsBytes(reply.marshal()); err != nil {
+			return err
+		}
+		return e.resume(t)
+	}
 
-	// parse alice public key
-	alicePub, err := ecdh.Unmarshal(apk)
+	i, cipher, err := negotiate(hello, e.hs.kexs, e.hs.ciphers)
 	if err != nil {
 		return err
 	}
 
-	// send bob public key
-	if _, err = e.WriteAsBytes(ecdh.Marshal()); err != nil {
+	kex, err := keyExchanges[hello.kexs[i]].newServer()
+	if err != nil {
 		return err
 	}
-
-	sharedKey, err := ecdh.GenerateShared(alicePub)
+	share, shared, err := kex.Respond(hello.shares[i])
 	if err != nil {
 		return err
 	}
-	e.SessionSecret = *sharedKey
+	e.useSuite(kex, hello.kexs[i], cipher)
+
+	reply := &serverHello{version: ProtocolVersion, kex: hello.kexs[i], cipher: cipher, share: share}
+	if _, err = e.WriteAsBytes(reply.marshal()); err != nil {
+		return err
+	}
 
 	// setup crypt
-	if e.crypt, err = crypto.NewGCM(*sharedKey); err != nil {
+	return e.mixKey(shared)
+}
+
+// ErrTranscriptMismatch is returned when the peer saw other handshake
+// messages than this side, the error names the side that noticed.
+var ErrTranscriptMismatch = errors.New("handshake transcript mismatch")
+
+func (c *Conn) transcriptMismatch() error {
+	side := "server"
+	if c.client {
+		side = "client"
+	}
+	return fmt.Errorf("%s detected %w", side, ErrTranscriptMismatch)
+}
+
+// writeFinished sends the MAC of the transcript so far under label.
+func (c *Conn) writeFinished(label string) error {
+	mac, err := c.keys.verifyData(label)
+	if err != nil {
 		return err
 	}
+	_, err = c.WriteAsBytes(mac)
+	return err
+}
 
+// readFinished checks the peer's MAC of the transcript against ours, before
+// the MAC itself joins the transcript.
+func (c *Conn) readFinished(label string) error {
+	want, err := c.keys.verifyData(label)
+	if err != nil {
+		return err
+	}
+	mac, err := c.ReadAsBytes()
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, want) {
+		return c.transcriptMismatch()
+	}
 	return nil
 }
 
+// serverHandshakeWithVerify and clientHandshakeWithVerify confirm the keys
+// and every handshake message, the negotiation included. The client sends a
+// MAC of the transcript, the server checks it and answers with a MAC of the
+// transcript including the client's. Any message changed on the way makes
+// the MACs differ.
 type serverHandshakeWithVerify struct{ *Conn }
 
 func (e *serverHandshakeWithVerify) Do() error {
-	bs, err := e.ReadAsBytes()
-	if err != nil {
+	if err := e.readFinished(labelClientFinished); err != nil {
 		return err
 	}
+	return e.writeFinished(labelServerFinished)
+}
 
-	data, err := e.crypt.Decrypt(bs, nil)
-	if err != nil {
+// serverHandshakeWithIdentity authenticates both static keys, Noise XX
+// style: the server's static key is mixed with the client's ephemeral one
+// and the client's static key with the server's ephemeral one. Only the
+// owners of both static private keys end up with the session key, which
+// Verify confirms.
+type serverHandshakeWithIdentity struct{ *Conn }
+
+func (e *serverHandshakeWithIdentity) Do() error {
+	if skip, err := e.skipIdentity(); skip || err != nil {
 		return err
 	}
 
-	// check client hello
-	if util.Bytes2String(data) != "Hello,Server" {
-		return errors.New("error client hello")
+	// send server static key
+	if err := e.WriteEncrypted(e.hs.identity.Public().Key[:]); err != nil {
+		return err
 	}
 
-	// create server hello
-	if data, err = e.crypt.Encrypt(util.String2Bytes("Hello,Client"), nil); err != nil {
+	es, err := crypto.DH(e.hs.identity, e.hs.peerEphemeral)
+	if err != nil {
+		return err
+	}
+	if err = e.mixKey(*es); err != nil {
 		return err
 	}
 
-	_, err = e.WriteAsBytes(data)
-	return err
+	// recv client static key
+	clientPub, err := e.readIdentity()
+	if err != nil {
+		return err
+	}
+
+	se, err := e.hs.ephemeral.GenerateShared(clientPub)
+	if err != nil {
+		return err
+	}
+	return e.mixKey(*se)
 }
 
-func (ServerHandshake) ECDH(conn *Conn) HandShake   { return &serverHandshakeWithECDH{conn} }
-func (ServerHandshake) Verify(conn *Conn) HandShake { return &serverHandshakeWithVerify{conn} }
+func (ServerHandshake) ECDH(conn *Conn) HandShake     { return &serverHandshakeWithECDH{conn} }
+func (ServerHandshake) PSK(conn *Conn) HandShake      { return &handshakeWithPSK{conn} }
+func (ServerHandshake) Identity(conn *Conn) HandShake { return &serverHandshakeWithIdentity{conn} }
+func (ServerHandshake) Verify(conn *Conn) HandShake   { return &serverHandshakeWithVerify{conn} }
 
 type ClientHandshake struct{}
 
+// clientHandshakeWithECDH offers the configured suites with a key share
+// for each key exchange and completes the one the server picked. The shares
+// are sent along with a ticket too, in case the server turns it down.
 type clientHandshakeWithECDH struct{ *Conn }
 
-func (e *clientHandshakeWithECDH) Do() (err error) {
-	ecdh, _ := crypto.NewCurve25519ECDH()
-
-	// send alice public key
-	if _, err = e.WriteAsBytes(ecdh.Marshal()); err != nil {
-		return
+func (e *clientHandshakeWithECDH) exchangeHello(hello *clientHello) (*serverHello, error) {
+	if _, err := e.WriteAsBytes(hello.marshal()); err != nil {
+		return nil, err
 	}
 
-	// recv bob public key
-	bpk, err := e.ReadAsBytes()
+	bs, err := e.ReadAsBytes()
 	if err != nil {
-		return
+		return nil, err
+	}
+	reply := &serverHello{}
+	if err = reply.unmarshal(bs); err != nil {
+		return nil, err
 	}
+	if reply.version != ProtocolVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, reply.version)
+	}
+	return reply, nil
+}
 
-	if len(bpk) != 32 {
-		return errors.New("invalid read size")
+func (e *clientHandshakeWithECDH) Do() error {
+	hello := &clientHello{version: ProtocolVersion, kexs: e.hs.kexs, ciphers: e.hs.ciphers}
+	kexs := make([]kexClient, len(hello.kexs))
+	for i, k := range hello.kexs {
+		kex, err := keyExchanges[k].newClient()
+		if err != nil {
+			return err
+		}
+		kexs[i] = kex
+		hello.shares = append(hello.shares, kex.Share())
+	}
+	if t := e.hs.ticket; t != nil && time.Now().Before(t.expires) && e.resumable(t) {
+		hello.ticket = t.sealed
 	}
 
-	// parse bob public key
-	bobPub, err := ecdh.Unmarshal(bpk)
+	reply, err := e.exchangeHello(hello)
+	if err == nil && reply.retry {
+		// the server forgot the first hello, so do we
+		e.keys.resetTranscript()
+		hello.cookie = reply.share
+		if reply, err = e.exchangeHello(hello); err == nil && reply.retry {
+			err = errSecondRetry
+		}
+	}
 	if err != nil {
 		return err
 	}
 
-	sharedKey, err := ecdh.GenerateShared(bobPub)
+	if reply.resumed {
+		t := e.hs.ticket
+		if hello.ticket == nil || reply.kex != t.kex || reply.cipher != t.cipher {
+			return errUnexpectedResume
+		}
+		return e.resume(t)
+	}
+
+	// the server may only pick what was offered
+	i := indexSuite(hello.kexs, reply.kex)
+	if i < 0 || !containsSuite(hello.ciphers, reply.cipher) {
+		return ErrNoCommonSuite
+	}
+
+	shared, err := kexs[i].Finish(reply.share)
 	if err != nil {
 		return err
 	}
-	e.SessionSecret = *sharedKey
+	e.useSuite(kexs[i], reply.kex, reply.cipher)
 
 	// setup crypt
-	if e.crypt, err = crypto.NewGCM(*sharedKey); err != nil {
-		return
-	}
-
-	return nil
+	return e.mixKey(shared)
 }
 
 type clientHandshakeWithVerify struct{ *Conn }
 
 func (e *clientHandshakeWithVerify) Do() error {
-	// create client hello
-	data, err := e.crypt.Encrypt(util.String2Bytes("Hello,Server"), nil)
-	if err != nil {
+	if err := e.writeFinished(labelClientFinished); err != nil {
 		return err
 	}
+	return e.readFinished(labelServerFinished)
+}
+
+// clientHandshakeWithIdentity is the client half of
+// serverHandshakeWithIdentity.
+type clientHandshakeWithIdentity struct{ *Conn }
 
-	if _, err = e.WriteAsBytes(data); err != nil {
+func (e *clientHandshakeWithIdentity) Do() error {
+	if skip, err := e.skipIdentity(); skip || err != nil {
 		return err
 	}
 
-	bs, err := e.ReadAsBytes()
+	// recv server static key
+	serverPub, err := e.readIdentity()
 	if err != nil {
 		return err
 	}
 
-	if data, err = e.crypt.Decrypt(bs, nil); err != nil {
+	es, err := e.hs.ephemeral.GenerateShared(serverPub)
+	if err != nil {
+		return err
+	}
+	if err = e.mixKey(*es); err != nil {
 		return err
 	}
 
-	// check server hello
-	if util.Bytes2String(data) != "Hello,Client" {
-		return errors.New("error server hello")
+	// send client static key
+	if err = e.WriteEncrypted(e.hs.identity.Public().Key[:]); err != nil {
+		return err
 	}
 
-	return nil
+	se, err := crypto.DH(e.hs.identity, e.hs.peerEphemeral)
+	if err != nil {
+		return err
+	}
+	return e.mixKey(*se)
 }
 
-func (ClientHandshake) ECDH(conn *Conn) HandShake   { return &clientHandshakeWithECDH{conn} }
-func (ClientHandshake) Verify(conn *Conn) HandShake { return &clientHandshakeWithVerify{conn} }
+func (ClientHandshake) ECDH(conn *Conn) HandShake     { return &clientHandshakeWithECDH{conn} }
+func (ClientHandshake) PSK(conn *Conn) HandShake      { return &handshakeWithPSK{conn} }
+func (ClientHandshake) Identity(conn *Conn) HandShake { return &clientHandshakeWithIdentity{conn} }
+func (ClientHandshake) Verify(conn *Conn) HandShake   { return &clientHandshakeWithVerify{conn} }
@@ -0,0 +1,179 @@
+package CVLAN
+
+import (
+	"errors"
+	"github.com/cvlan/core/util"
+)
+
+var errMalformedHello = errors.New("malformed hello")
+
+// clientHello is the client's first message. It offers key exchanges and
+// ciphers in preference order and a key share for each key exchange, so the
+// server can answer whichever it picks without another round trip. A
+// resumption ticket and a cookie, if any, come last.
+//
+//	version | n | kex... | n | cipher... | (len16 | share)... | len16 | ticket | len16 | cookie
+type clientHello struct {
+	version uint8
+	kexs    []KeyExchange
+	ciphers []Cipher
+	shares  [][]byte
+	ticket  []byte
+	cookie  []byte
+}
+
+func (h *clientHello) marshal() []byte {
+	b := []byte{h.version, uint8(len(h.kexs))}
+	for _, k := range h.kexs {
+		b = append(b, uint8(k))
+	}
+	b = append(b, uint8(len(h.ciphers)))
+	for _, c := range h.ciphers {
+		b = append(b, uint8(c))
+	}
+	for _, share := range h.shares {
+		b = append(b, util.TypeEncoder[uint16](uint16(len(share)))...)
+		b = append(b, share...)
+	}
+	b = append(b, util.TypeEncoder[uint16](uint16(len(h.ticket)))...)
+	b = append(b, h.ticket...)
+	b = append(b, util.TypeEncoder[uint16](uint16(len(h.cookie)))...)
+	return append(b, h.cookie...)
+}
+
+func (h *clientHello) unmarshal(b []byte) error {
+	r := helloReader{b: b}
+	h.version = r.u8()
+	for n := r.u8(); n > 0 && r.err == nil; n-- {
+		h.kexs = append(h.kexs, KeyExchange(r.u8()))
+	}
+	for n := r.u8(); n > 0 && r.err == nil; n-- {
+		h.ciphers = append(h.ciphers, Cipher(r.u8()))
+	}
+	for range h.kexs {
+		h.shares = append(h.shares, r.bytes16())
+	}
+	h.ticket = r.bytes16()
+	h.cookie = r.bytes16()
+	return r.done()
+}
+
+// serverHello answers a clientHello with the picked suite and the server's
+// key share. When the server accepted the ticket, the suite is the ticket's
+// and the share a random nonce. A retry asks for the hello again with the
+// cookie in share, kex and cipher are zero then.
+//
+//	version | kex | cipher | flags | len16 | share
+type serverHello struct {
+	version uint8
+	kex     KeyExchange
+	cipher  Cipher
+	resumed bool
+	retry   bool
+	share   []byte
+}
+
+const (
+	helloResumed uint8 = 1 << iota
+	helloRetry
+)
+
+func (h *serverHello) marshal() []byte {
+	var flags uint8
+	if h.resumed {
+		flags |= helloResumed
+	}
+	if h.retry {
+		flags |= helloRetry
+	}
+	b := []byte{h.version, uint8(h.kex), uint8(h.cipher), flags}
+	b = append(b, util.TypeEncoder[uint16](uint16(len(h.share)))...)
+	return append(b, h.share...)
+}
+
+func (h *serverHello) unmarshal(b []byte) error {
+	r := helloReader{b: b}
+	h.version = r.u8()
+	h.kex = KeyExchange(r.u8())
+	h.cipher = Cipher(r.u8())
+	flags := r.u8()
+	h.resumed, h.retry = flags&helloResumed != 0, flags&helloRetry != 0
+	h.share = r.bytes16()
+	return r.done()
+}
+
+// helloReader reads hello fields and remembers the first short read.
+type helloReader struct {
+	b   []byte
+	err error
+}
+
+func (r *helloReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errMalformedHello
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *helloReader) u8() uint8 {
+	if v := r.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *helloReader) bytes16() []byte {
+	v := r.next(2)
+	if v == nil {
+		return nil
+	}
+	return r.next(int(util.TypeDecoder[uint16](v)))
+}
+
+func (r *helloReader) done() error {
+	if r.err == nil && len(r.b) != 0 {
+		r.err = errMalformedHello
+	}
+	return r.err
+}
+
+// negotiate picks the first key exchange and cipher of the client's lists
+// the server accepts too, so the client's preference wins.
+func negotiate(hello *clientHello, kexs []KeyExchange, ciphers []Cipher) (int, Cipher, error) {
+	kex, cipher := -1, Cipher(0)
+	for i, k := range hello.kexs {
+		if containsSuite(kexs, k) {
+			kex = i
+			break
+		}
+	}
+	for _, c := range hello.ciphers {
+		if containsSuite(ciphers, c) {
+			cipher = c
+			break
+		}
+	}
+	if kex < 0 || cipher == 0 {
+		return 0, 0, ErrNoCommonSuite
+	}
+	return kex, cipher, nil
+}
+
+func containsSuite[T comparable](list []T, v T) bool {
+	return indexSuite(list, v) >= 0
+}
+
+func indexSuite[T comparable](list []T, v T) int {
+	for i, x := range list {
+		if x == v {
+			return i
+		}
+	}
+	return -1
+}
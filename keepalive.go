@@ -0,0 +1,91 @@
+package CVLAN
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMaxMissed = 3
+
+// ErrPeerDead is the cause the connection's context is cancelled with when
+// the peer stopped sending keepalives.
+var ErrPeerDead = errors.New("peer dead")
+
+// KeepalivePolicy makes a connection send an encrypted keepalive record
+// every Interval, zero disables it. The peer is declared dead when a Read is
+// waiting and nothing arrived for MaxMissed intervals, which defaults to 3.
+// Both sides need keepalives enabled, or an idle peer looks dead.
+type KeepalivePolicy struct {
+	Interval  time.Duration
+	MaxMissed int
+}
+
+type keepaliveState struct {
+	policy KeepalivePolicy
+
+	// unix nanoseconds of the last record read from the peer
+	lastRecv atomic.Int64
+	// unix nanoseconds since a Read is waiting, zero if none is
+	readSince atomic.Int64
+}
+
+func (c *Conn) startKeepalive() {
+	if c.keepalive.policy.Interval <= 0 {
+		return
+	}
+	if c.keepalive.policy.MaxMissed <= 0 {
+		c.keepalive.policy.MaxMissed = defaultMaxMissed
+	}
+	c.keepalive.lastRecv.Store(time.Now().UnixNano())
+	go c.keepaliveLoop()
+}
+
+func (c *Conn) keepaliveLoop() {
+	policy := c.keepalive.policy
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// a Write in progress is a beat of its own
+		if c.writeMu.TryLock() {
+			var err error
+			if !c.writeClosed {
+				err = c.writeSealed(recordKeepalive, nil)
+			}
+			c.writeMu.Unlock()
+			if err != nil {
+				c.peerDead(fmt.Errorf("%w: keepalive failed: %v", ErrPeerDead, err))
+				return
+			}
+		}
+
+		// without a pending Read nobody takes the peer's records off the
+		// transport, silence means nothing then
+		since := c.keepalive.readSince.Load()
+		if since == 0 {
+			continue
+		}
+		if last := c.keepalive.lastRecv.Load(); last > since {
+			since = last
+		}
+		if silent := time.Since(time.Unix(0, since)); silent >= time.Duration(policy.MaxMissed)*policy.Interval {
+			c.peerDead(fmt.Errorf("%w: nothing received for %s", ErrPeerDead, silent.Round(time.Millisecond)))
+			return
+		}
+	}
+}
+
+// peerDead cancels the connection with cause and closes the transport, so a
+// blocked Read returns.
+func (c *Conn) peerDead(cause error) {
+	c.cancelFunc(cause)
+	c.conn.Close()
+}
@@ -0,0 +1,74 @@
+package CVLAN
+
+import (
+	"crypto/mlkem"
+	"github.com/cvlan/core/crypto"
+)
+
+// hybridKex combines X25519 with an ML-KEM-768 encapsulation. The client
+// sends its X25519 key and an encapsulation key, the server its X25519 key
+// and the ciphertext. Both shared secrets feed the key schedule, the keys
+// stay safe as long as either of them holds, also against a quantum
+// computer recording the traffic today.
+//
+//	client share: x25519 | encapsulation key
+//	server share: x25519 | ciphertext
+type hybridKex struct {
+	x25519 *ecdhKex[crypto.PubKey]
+	dk     *mlkem.DecapsulationKey768
+}
+
+// newHybridKex returns the client side with a fresh decapsulation key, the
+// server side only encapsulates.
+func newHybridKex(client bool) (*hybridKex, error) {
+	x, err := newX25519Kex()
+	if err != nil {
+		return nil, err
+	}
+	h := &hybridKex{x25519: x}
+	if client {
+		if h.dk, err = mlkem.GenerateKey768(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *hybridKex) Share() []byte {
+	return append(h.x25519.Share(), h.dk.EncapsulationKey().Bytes()...)
+}
+
+func (h *hybridKex) Finish(peerShare []byte) ([]byte, error) {
+	if len(peerShare) != h.x25519.size+mlkem.CiphertextSize768 {
+		return nil, errMalformedShare
+	}
+	classic, err := h.x25519.Finish(peerShare[:h.x25519.size])
+	if err != nil {
+		return nil, err
+	}
+	pq, err := h.dk.Decapsulate(peerShare[h.x25519.size:])
+	if err != nil {
+		return nil, err
+	}
+	return append(classic, pq...), nil
+}
+
+func (h *hybridKex) Respond(peerShare []byte) ([]byte, []byte, error) {
+	if len(peerShare) != h.x25519.size+mlkem.EncapsulationKeySize768 {
+		return nil, nil, errMalformedShare
+	}
+	ek, err := mlkem.NewEncapsulationKey768(peerShare[h.x25519.size:])
+	if err != nil {
+		return nil, nil, err
+	}
+	classic, err := h.x25519.Finish(peerShare[:h.x25519.size])
+	if err != nil {
+		return nil, nil, err
+	}
+	pq, ciphertext := ek.Encapsulate()
+	return append(h.x25519.Share(), ciphertext...), append(classic, pq...), nil
+}
+
+func (h *hybridKex) ephemeral() (crypto.ECDH[crypto.PubKey], *crypto.PubKey) {
+	return h.x25519.ephemeral()
+}
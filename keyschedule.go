@@ -0,0 +1,199 @@
+package CVLAN
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"github.com/cvlan/core/crypto"
+	"github.com/cvlan/core/util"
+	"golang.org/x/crypto/hkdf"
+	"hash"
+	"io"
+)
+
+const (
+	labelClientHandshake = "cvlan c hs traffic"
+	labelServerHandshake = "cvlan s hs traffic"
+	labelClientTraffic   = "cvlan c ap traffic"
+	labelServerTraffic   = "cvlan s ap traffic"
+	labelClientFinished  = "cvlan c finished"
+	labelServerFinished  = "cvlan s finished"
+	labelExporter        = "cvlan exp master"
+	labelResumption      = "cvlan res master"
+	labelExport          = "cvlan exporter"
+	labelTrafficKey      = "cvlan key"
+	labelKeyUpdate       = "cvlan traffic upd"
+
+	keySize = 32
+)
+
+var (
+	errExportBeforeHandshake = errors.New("keying material exported before the handshake finished")
+	errExportTooLong         = errors.New("exporter label or context too long")
+	errExportLength          = errors.New("negative exporter length")
+)
+
+// keySchedule derives every key of a connection. Each exchange of the
+// handshake is chained into secret with HKDF-Extract. Keys are expanded
+// from it together with the hash of all handshake messages so far, once for
+// each direction, so both directions never share a key and the keys are
+// bound to everything both sides saw.
+type keySchedule struct {
+	client bool
+	// constructs the negotiated cipher
+	newCipher func(sealKey, openKey []byte) (crypto.AES, error)
+
+	// chaining key during the handshake
+	secret     []byte
+	transcript hash.Hash
+	exporter   []byte
+
+	// traffic secrets of each direction after the handshake, sendSecret is
+	// guarded by Conn.writeMu and recvSecret by Conn.readMu
+	sendSecret []byte
+	recvSecret []byte
+}
+
+func newKeySchedule(client bool) *keySchedule {
+	return &keySchedule{client: client, newCipher: crypto.NewGCM, transcript: sha256.New()}
+}
+
+// addMessage appends a handshake message to the transcript.
+func (k *keySchedule) addMessage(msg []byte) {
+	k.transcript.Write(util.TypeEncoder[uint32](uint32(len(msg))))
+	k.transcript.Write(msg)
+}
+
+// resetTranscript forgets the messages so far, after a cookie request.
+func (k *keySchedule) resetTranscript() {
+	k.transcript.Reset()
+}
+
+func (k *keySchedule) mix(secret []byte) {
+	k.secret = hkdf.Extract(sha256.New, secret, k.secret)
+}
+
+// hkdfLabel frames label and context into the info of HKDF-Expand.
+func hkdfLabel(label string, context []byte) []byte {
+	info := make([]byte, 0, 4+len(label)+len(context))
+	info = append(info, util.TypeEncoder[uint16](uint16(len(label)))...)
+	info = append(info, label...)
+	info = append(info, util.TypeEncoder[uint16](uint16(len(context)))...)
+	return append(info, context...)
+}
+
+func expand(secret []byte, label string, context []byte, length int) ([]byte, error) {
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, hkdfLabel(label, context)), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (k *keySchedule) expand(label string, context []byte, length int) ([]byte, error) {
+	return expand(k.secret, label, context, length)
+}
+
+// cipher derives the keys of both directions and returns a cipher sealing
+// with ours and opening with the peer's.
+func (k *keySchedule) cipher(clientLabel, serverLabel string) (crypto.AES, error) {
+	th := k.transcript.Sum(nil)
+	clientKey, err := k.expand(clientLabel, th, keySize)
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := k.expand(serverLabel, th, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.client {
+		return k.newCipher(clientKey, serverKey)
+	}
+	return k.newCipher(serverKey, clientKey)
+}
+
+// verifyData is the MAC of the transcript so far under a key only both
+// ends of the key exchange can derive.
+func (k *keySchedule) verifyData(label string) ([]byte, error) {
+	key, err := k.expand(label, nil, keySize)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(k.transcript.Sum(nil))
+	return mac.Sum(nil), nil
+}
+
+func (k *keySchedule) handshakeCipher() (crypto.AES, error) {
+	return k.cipher(labelClientHandshake, labelServerHandshake)
+}
+
+// resumptionSecret is the secret of a ticket, bound to the whole verified
+// handshake.
+func (k *keySchedule) resumptionSecret() ([]byte, error) {
+	return k.expand(labelResumption, k.transcript.Sum(nil), keySize)
+}
+
+// finish derives the exporter secret and the traffic secrets, and returns
+// the first traffic ciphers of both directions.
+func (k *keySchedule) finish() (write, read crypto.AES, err error) {
+	th := k.transcript.Sum(nil)
+	if k.exporter, err = k.expand(labelExporter, th, keySize); err != nil {
+		return nil, nil, err
+	}
+	client, err := k.expand(labelClientTraffic, th, keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := k.expand(labelServerTraffic, th, keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	k.sendSecret, k.recvSecret = server, client
+	if k.client {
+		k.sendSecret, k.recvSecret = client, server
+	}
+
+	if write, err = k.trafficCipher(k.sendSecret); err != nil {
+		return nil, nil, err
+	}
+	if read, err = k.trafficCipher(k.recvSecret); err != nil {
+		return nil, nil, err
+	}
+	return write, read, nil
+}
+
+// trafficCipher returns a cipher for one direction, it only seals or only
+// opens, so both keys are the same.
+func (k *keySchedule) trafficCipher(secret []byte) (crypto.AES, error) {
+	key, err := expand(secret, labelTrafficKey, nil, keySize)
+	if err != nil {
+		return nil, err
+	}
+	return k.newCipher(key, key)
+}
+
+// nextSecret is the traffic secret after a key update. The old secret can't
+// be recovered from the new one, so new keys don't expose earlier traffic.
+func nextSecret(secret []byte) ([]byte, error) {
+	return expand(secret, labelKeyUpdate, nil, keySize)
+}
+
+// ExportKeyingMaterial derives length bytes bound to this connection, the
+// label and context, the same on both ends. Applications use it for their
+// own channel-bound secrets. It doesn't change when the connection rekeys.
+func (c *Conn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if c.keys == nil || c.keys.exporter == nil {
+		return nil, errExportBeforeHandshake
+	}
+	if length < 0 {
+		return nil, errExportLength
+	}
+	// label and context are framed by hkdfLabel, and the frame again as the
+	// context of labelExport, so together they fit its uint16 length
+	if 4+len(label)+len(context) > 0xffff {
+		return nil, errExportTooLong
+	}
+	return expand(c.keys.exporter, labelExport, hkdfLabel(label, context), length)
+}
@@ -0,0 +1,136 @@
+package CVLAN
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/cvlan/core/crypto"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrPeerKeyChanged is returned by the client's handshake when the server
+// presents another static key than the one recorded for its name. Either
+// the server's key was replaced or someone is in the middle.
+var ErrPeerKeyChanged = errors.New("peer key changed")
+
+// KnownPeers records the static keys of servers by name, the first key seen
+// for a name is trusted from then on.
+type KnownPeers interface {
+	// Lookup returns the key recorded for name, nil if there is none.
+	Lookup(name string) (*crypto.PubKey, error)
+	// Add records key for name.
+	Add(name string, key *crypto.PubKey) error
+}
+
+// KnownPeersFile is a KnownPeers kept in a file, one "name key" line per
+// peer with the key base64 encoded, like ssh's known_hosts.
+type KnownPeersFile struct {
+	path string
+
+	mu    sync.Mutex
+	peers map[string]crypto.PubKey
+}
+
+var _ KnownPeers = (*KnownPeersFile)(nil)
+
+// OpenKnownPeers loads the known peers at path, a missing file is created on
+// the first Add.
+func OpenKnownPeers(path string) (*KnownPeersFile, error) {
+	k := &KnownPeersFile{path: path, peers: make(map[string]crypto.PubKey)}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, encoded, ok := strings.Cut(text, " ")
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if !ok || err != nil || len(key) != len(crypto.PubKey{}.Key) {
+			return nil, fmt.Errorf("%s:%d: malformed known peer", path, line)
+		}
+		var pub crypto.PubKey
+		copy(pub.Key[:], key)
+		k.peers[name] = pub
+	}
+	return k, scanner.Err()
+}
+
+func (k *KnownPeersFile) Lookup(name string) (*crypto.PubKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if pub, ok := k.peers[name]; ok {
+		return &pub, nil
+	}
+	return nil, nil
+}
+
+func (k *KnownPeersFile) Add(name string, key *crypto.PubKey) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") || strings.HasPrefix(name, "#") {
+		return fmt.Errorf("invalid peer name %q", name)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	f, err := os.OpenFile(k.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(f, "%s %s\n", name, base64.StdEncoding.EncodeToString(key.Key[:])); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	k.peers[name] = *key
+	return nil
+}
+
+// knownPeer checks the server's key against the one recorded for its name.
+// An unknown key is only recorded by clientHandshakeWithKnownPeers, once the
+// handshake proved the server owns it.
+func (c *Conn) knownPeer(peer *crypto.PubKey) error {
+	known, err := c.hs.knownPeers.Lookup(c.hs.peerName)
+	if err != nil || known == nil {
+		return err
+	}
+	if *known != *peer {
+		return fmt.Errorf("%w: %s was %s, now presents %s", ErrPeerKeyChanged,
+			c.hs.peerName, fingerprint(known), fingerprint(peer))
+	}
+	return nil
+}
+
+func fingerprint(key *crypto.PubKey) string {
+	return base64.StdEncoding.EncodeToString(key.Key[:])
+}
+
+// clientHandshakeWithKnownPeers records the server's key on first use, after
+// Verify confirmed the server owns it.
+type clientHandshakeWithKnownPeers struct{ *Conn }
+
+func (e *clientHandshakeWithKnownPeers) Do() error {
+	if e.hs.knownPeers == nil || e.peerIdentity == nil {
+		return nil
+	}
+	known, err := e.hs.knownPeers.Lookup(e.hs.peerName)
+	if err != nil || known != nil {
+		return err
+	}
+	return e.hs.knownPeers.Add(e.hs.peerName, e.peerIdentity)
+}
+
+func (ClientHandshake) KnownPeers(conn *Conn) HandShake { return &clientHandshakeWithKnownPeers{conn} }
@@ -0,0 +1,233 @@
+package CVLAN
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultMaxPending       = 64
+
+	// how long serve waits after a temporary Accept error, doubling up to
+	// the maximum while they go on
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// ListenerCfg sets up a Listener, the zero value serves with a zero
+// ServerCfg.
+type ListenerCfg struct {
+	// Server is the template every accepted connection is set up with,
+	// its Conn field is ignored.
+	Server *ServerCfg
+	// HandshakeTimeout bounds the whole handshake of a single connection.
+	HandshakeTimeout time.Duration
+	// MaxPending bounds the handshakes running at once. Established
+	// connections count until Accept returns them, the listener stops
+	// accepting sockets while all slots are taken.
+	MaxPending int
+	// CookieThreshold makes clients answer a cookie request before the key
+	// exchange while this many other handshakes are pending, unless
+	// Server.Cookies sets a policy of its own. Zero or a threshold of
+	// MaxPending or more never asks.
+	CookieThreshold int
+}
+
+// Listener accepts connections from a net.Listener and runs the server
+// handshake for each of them concurrently, so a slow client only ever holds
+// its own slot.
+type Listener struct {
+	listener net.Listener
+	cfg      ListenerCfg
+
+	slots chan struct{}
+	conns chan *Conn
+
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	closeOnce sync.Once
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+func (l *Listener) serve() {
+	var delay time.Duration
+	for {
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.ctx.Done():
+			return
+		}
+
+		rawConn, err := l.listener.Accept()
+		if err != nil {
+			<-l.slots
+			// running out of file descriptors and the like passes, wait
+			// and try again like net/http does
+			if temporary(err) && l.ctx.Err() == nil {
+				if delay = 2 * delay; delay == 0 {
+					delay = minAcceptDelay
+				} else if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				select {
+				case <-time.After(delay):
+					continue
+				case <-l.ctx.Done():
+					return
+				}
+			}
+			l.cancel(err)
+			return
+		}
+		delay = 0
+		go l.handshake(rawConn)
+	}
+}
+
+func temporary(err error) bool {
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+func (l *Listener) handshake(rawConn net.Conn) {
+	defer func() { <-l.slots }()
+
+	ctx, cancel := context.WithTimeout(l.ctx, l.cfg.HandshakeTimeout)
+	defer cancel()
+	stop := watchHandshake(ctx, rawConn)
+
+	cfg := *l.cfg.Server
+	cfg.Conn = rawConn
+	conn, err := NewServer(&cfg)
+	if stop() != nil || err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		rawConn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.ctx.Done():
+		conn.Close()
+	}
+}
+
+// Accept waits for the next connection that finished its handshake.
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptConn()
+}
+
+func (l *Listener) AcceptConn() (*Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, context.Cause(l.ctx)
+	}
+}
+
+// Close stops accepting, handshakes still running are aborted. Connections
+// already returned by Accept stay open.
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.cancel(net.ErrClosed)
+		err = l.listener.Close()
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// NewListener serves listener with cfg, nil is the zero ListenerCfg. When
+// cfg.Server is rejected, Accept fails with the reason.
+func NewListener(listener net.Listener, cfg *ListenerCfg) *Listener {
+	l := &Listener{listener: listener}
+	if cfg != nil {
+		l.cfg = *cfg
+	}
+	if l.cfg.Server == nil {
+		l.cfg.Server = &ServerCfg{}
+	}
+	if l.cfg.Server.Context == nil {
+		server := *l.cfg.Server
+		server.Context = context.Background()
+		l.cfg.Server = &server
+	}
+	if l.cfg.HandshakeTimeout <= 0 {
+		l.cfg.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	if l.cfg.MaxPending <= 0 {
+		l.cfg.MaxPending = defaultMaxPending
+	}
+
+	l.slots = make(chan struct{}, l.cfg.MaxPending)
+	if l.cfg.CookieThreshold > 0 && l.cfg.Server.Cookies == nil {
+		key := make([]byte, 32)
+		rand.Read(key)
+		server := *l.cfg.Server
+		server.Cookies = &CookiePolicy{
+			Key: key,
+			// the asking handshake holds a slot too
+			Required: func() bool { return len(l.slots) > l.cfg.CookieThreshold },
+		}
+		l.cfg.Server = &server
+	}
+	l.conns = make(chan *Conn)
+	l.ctx, l.cancel = context.WithCancelCause(context.Background())
+
+	// every handshake would fail, Accept reports why instead
+	if _, _, err := l.cfg.Server.check(); err != nil {
+		l.cancel(err)
+		return l
+	}
+	go l.serve()
+	return l
+}
+
+// Listen announces on the TCP address and returns a Listener for it.
+func Listen(addr string, cfg *ListenerCfg) (*Listener, error) {
+	listener, err := NewTCPListener(addr)
+	if err != nil {
+		return nil, err
+	}
+	l := NewListener(listener, cfg)
+	if err = context.Cause(l.ctx); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// watchHandshake closes conn once ctx is done, that is the only way to stop
+// a handshake blocked on a peer that went quiet. The returned stop ends the
+// watch and reports ctx's error if conn was closed.
+func watchHandshake(ctx context.Context, conn io.Closer) (stop func() error) {
+	done := make(chan struct{})
+	aborted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			aborted <- ctx.Err()
+		case <-done:
+			aborted <- nil
+		}
+	}()
+
+	return func() error {
+		close(done)
+		return <-aborted
+	}
+}
@@ -0,0 +1,203 @@
+package CVLAN_test
+
+import (
+	"context"
+	"errors"
+	CVLAN "github.com/cvlan/core"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListener_Accept(t *testing.T) {
+	listener, err := CVLAN.Listen("127.0.0.1:0", &CVLAN.ListenerCfg{
+		Server:           &CVLAN.ServerCfg{Timeout: 5 * time.Second},
+		HandshakeTimeout: 200 * time.Millisecond,
+		MaxPending:       2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	addr := listener.Addr().String()
+
+	// a client that never sends its hello must not hold up the others
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	go func() {
+		tcpConn, err := CVLAN.NewTCPDialer(addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn, err := CVLAN.NewClient(&CVLAN.ClientCfg{
+			Context: context.Background(),
+			Conn:    tcpConn,
+			Timeout: 5 * time.Second,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("Hello"))
+		io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got := make([]byte, 5)
+	if _, err = io.ReadFull(conn, got); err != nil || string(got) != "Hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// the stalled client is dropped once its handshake times out
+	stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = stalled.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("stalled client not dropped: %v", err)
+	}
+
+	listener.Close()
+	if _, err = listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("accept after close: %v", err)
+	}
+}
+
+// flakyListener fails its first Accept with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failed bool
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if !l.failed {
+		l.failed = true
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestListener_TemporaryAcceptError(t *testing.T) {
+	tcp, err := CVLAN.NewTCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := CVLAN.NewListener(&flakyListener{Listener: tcp}, nil)
+	defer listener.Close()
+
+	go func() {
+		tcpConn, err := CVLAN.NewTCPDialer(listener.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn, err := CVLAN.NewClient(&CVLAN.ClientCfg{Context: context.Background(), Conn: tcpConn})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// headConn keeps the first bytes read from the transport.
+type headConn struct {
+	net.Conn
+	head []byte
+}
+
+func (c *headConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if room := 16 - len(c.head); room > 0 {
+		c.head = append(c.head, p[:min(n, room)]...)
+	}
+	return n, err
+}
+
+func TestListener_CookieUnderLoad(t *testing.T) {
+	listener, err := CVLAN.Listen("127.0.0.1:0", &CVLAN.ListenerCfg{
+		HandshakeTimeout: 5 * time.Second,
+		CookieThreshold:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// a stalled handshake keeps the listener at the threshold
+	stalled, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	tcpConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &headConn{Conn: tcpConn}
+	go func() {
+		conn, err := CVLAN.NewClient(&CVLAN.ClientCfg{Context: context.Background(), Conn: transport})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("Hello"))
+		io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got := make([]byte, 5)
+	if _, err = io.ReadFull(conn, got); err != nil || string(got) != "Hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// the server's first record is a hello asking for a cookie:
+	// type | len32 | version | kex | cipher | flags
+	if head := transport.head; len(head) < 9 || head[0] != 1 || head[8]&2 == 0 {
+		t.Fatalf("no cookie requested, server sent % x", head)
+	}
+}
+
+func TestListener_BadServerCfg(t *testing.T) {
+	cfg := &CVLAN.ListenerCfg{Server: &CVLAN.ServerCfg{Ciphers: []CVLAN.Cipher{99}}}
+	if _, err := CVLAN.Listen("127.0.0.1:0", cfg); err == nil {
+		t.Fatal("listening with an unknown cipher")
+	}
+
+	tcp, err := CVLAN.NewTCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := CVLAN.NewListener(tcp, cfg)
+	defer listener.Close()
+	if _, err = listener.Accept(); err == nil {
+		t.Fatal("accepted with an unknown cipher")
+	}
+}
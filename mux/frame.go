@@ -0,0 +1,53 @@
+package mux
+
+import (
+	"github.com/cvlan/core/util"
+)
+
+type frameType uint8
+
+const (
+	// payload is stream data
+	frameData frameType = iota + 1
+	// length is a receive window increment, there is no payload
+	frameWindow
+)
+
+type frameFlag uint8
+
+const (
+	// opens the stream
+	flagSYN frameFlag = 1 << iota
+	// the sender finished writing
+	flagFIN
+	// the stream is aborted in both directions
+	flagRST
+)
+
+const (
+	// type(1) + flags(1) + stream id(4) + length(4)
+	frameHeaderSize = 10
+
+	maxFrameSize = 1 << 16
+)
+
+type frameHeader struct {
+	typ    frameType
+	flags  frameFlag
+	stream uint32
+	length uint32
+}
+
+func (h *frameHeader) encode(b []byte) {
+	b[0] = byte(h.typ)
+	b[1] = byte(h.flags)
+	copy(b[2:6], util.TypeEncoder[uint32](h.stream))
+	copy(b[6:10], util.TypeEncoder[uint32](h.length))
+}
+
+func (h *frameHeader) decode(b []byte) {
+	h.typ = frameType(b[0])
+	h.flags = frameFlag(b[1])
+	h.stream = util.TypeDecoder[uint32](b[2:6])
+	h.length = util.TypeDecoder[uint32](b[6:10])
+}
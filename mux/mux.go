@@ -0,0 +1,290 @@
+// Package mux runs many independent bidirectional streams over a single
+// connection, usually an established *CVLAN.Conn.
+package mux
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+)
+
+var (
+	ErrSessionClosed  = errors.New("mux: session closed")
+	ErrStreamClosed   = errors.New("mux: stream closed")
+	ErrStreamReset    = errors.New("mux: stream reset")
+	ErrStreamsExhaust = errors.New("mux: stream ids exhausted")
+	errProtocol       = errors.New("mux: protocol error")
+)
+
+const (
+	defaultWindow        = 256 << 10
+	defaultAcceptBacklog = 256
+)
+
+type Config struct {
+	// Window is how many bytes the peer may send on a stream before the
+	// application reads them.
+	Window uint32
+	// AcceptBacklog bounds the streams opened by the peer and not yet
+	// returned by AcceptStream, further streams are reset.
+	AcceptBacklog int
+}
+
+// Session multiplexes streams over conn. Both ends can open streams, the
+// client uses odd and the server even stream ids.
+type Session struct {
+	conn io.ReadWriteCloser
+	cfg  Config
+
+	writeMu sync.Mutex
+	header  [frameHeaderSize]byte
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+
+	accept chan *Stream
+
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+func newSession(conn io.ReadWriteCloser, cfg *Config, client bool) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		done:    make(chan struct{}),
+	}
+	if cfg != nil {
+		s.cfg = *cfg
+	}
+	if s.cfg.Window == 0 {
+		s.cfg.Window = defaultWindow
+	}
+	if s.cfg.AcceptBacklog <= 0 {
+		s.cfg.AcceptBacklog = defaultAcceptBacklog
+	}
+	if client {
+		s.nextID = 1
+	}
+	s.accept = make(chan *Stream, s.cfg.AcceptBacklog)
+
+	go s.recvLoop()
+	return s
+}
+
+func Client(conn io.ReadWriteCloser, cfg *Config) *Session {
+	return newSession(conn, cfg, true)
+}
+
+func Server(conn io.ReadWriteCloser, cfg *Config) *Session {
+	return newSession(conn, cfg, false)
+}
+
+// OpenStream opens a new stream, it can be written to right away.
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	if s.nextID > math.MaxUint32-2 {
+		s.mu.Unlock()
+		return nil, ErrStreamsExhaust
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameWindow, flagSYN, id, nil, 0); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream waits for the next stream opened by the peer.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// Accept lets a Session serve as net.Listener.
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+func (s *Session) Addr() net.Addr {
+	if a, ok := s.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return a.LocalAddr()
+	}
+	return muxAddr{}
+}
+
+// Close closes the underlying connection, all streams fail from then on.
+func (s *Session) Close() error {
+	return s.close(ErrSessionClosed)
+}
+
+// Done is closed once the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session was closed, nil while it is open.
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) close(cause error) (err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = cause
+		close(s.done)
+		s.mu.Unlock()
+		err = s.conn.Close()
+	})
+	return
+}
+
+func (s *Session) writeFrame(typ frameType, flags frameFlag, id uint32, payload []byte, length uint32) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.isClosed() {
+		return s.err
+	}
+
+	if typ == frameData {
+		length = uint32(len(payload))
+	}
+	h := frameHeader{typ: typ, flags: flags, stream: id, length: length}
+	h.encode(s.header[:])
+
+	// one write per frame, so record based connections send it as one record
+	buf := make([]byte, 0, frameHeaderSize+len(payload))
+	buf = append(append(buf, s.header[:]...), payload...)
+	if _, err := s.conn.Write(buf); err != nil {
+		s.close(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	header := make([]byte, frameHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.close(err)
+			return
+		}
+		var h frameHeader
+		h.decode(header)
+
+		if err := s.handleFrame(&h); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(h *frameHeader) error {
+	var payload []byte
+	switch h.typ {
+	case frameData:
+		if h.length > maxFrameSize {
+			return errProtocol
+		}
+		payload = make([]byte, h.length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return err
+		}
+	case frameWindow:
+	default:
+		return errProtocol
+	}
+
+	stream, err := s.lookupStream(h)
+	if err != nil || stream == nil {
+		return err
+	}
+
+	switch h.typ {
+	case frameData:
+		if err = stream.receive(payload); err != nil {
+			return err
+		}
+	case frameWindow:
+		stream.grantWindow(h.length)
+	}
+
+	if h.flags&flagRST != 0 {
+		stream.remoteReset()
+	} else if h.flags&flagFIN != 0 {
+		stream.remoteClose()
+	}
+	return nil
+}
+
+// lookupStream returns the stream a frame belongs to, opening it for SYN.
+// Frames of streams that are already gone return nil.
+func (s *Session) lookupStream(h *frameHeader) (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if h.flags&flagSYN == 0 {
+		return s.streams[h.stream], nil
+	}
+
+	// the peer opens ids of the other parity
+	if h.stream == 0 || h.stream%2 == s.nextID%2 {
+		return nil, errProtocol
+	}
+	if _, ok := s.streams[h.stream]; ok {
+		return nil, errProtocol
+	}
+
+	stream := newStream(s, h.stream)
+	select {
+	case s.accept <- stream:
+		s.streams[h.stream] = stream
+		return stream, nil
+	default:
+		go s.writeFrame(frameWindow, flagRST, h.stream, nil, 0)
+		return nil, nil
+	}
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+type muxAddr struct{}
+
+func (muxAddr) Network() string { return "mux" }
+func (muxAddr) String() string  { return "mux" }
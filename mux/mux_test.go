@@ -0,0 +1,204 @@
+package mux_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	CVLAN "github.com/cvlan/core"
+	"github.com/cvlan/core/mux"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func newSessions(t *testing.T, cfg *mux.Config) (client, server *mux.Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server = mux.Client(a, cfg), mux.Server(b, cfg)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestSession_Streams(t *testing.T) {
+	client, server := newSessions(t, &mux.Config{Window: 1 << 10})
+
+	// echo every stream until the client finishes writing
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.CloseWrite()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			stream, err := client.OpenStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+
+			// far more than the window, the writer has to wait for updates
+			msg := bytes.Repeat([]byte{byte(i)}, 64<<10)
+			go func() {
+				stream.Write(msg)
+				stream.CloseWrite()
+			}()
+
+			got, err := io.ReadAll(stream)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("stream %d: got %d bytes want %d", stream.ID(), len(got), len(msg))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStream_Reset(t *testing.T) {
+	client, server := newSessions(t, nil)
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte("ping"))
+
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err = io.ReadFull(accepted, got); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted.Reset()
+	if _, err = stream.Read(got); !errors.Is(err, mux.ErrStreamReset) {
+		t.Fatalf("read after reset: %v", err)
+	}
+	if _, err = stream.Write(got); !errors.Is(err, mux.ErrStreamReset) {
+		t.Fatalf("write after reset: %v", err)
+	}
+
+	// other streams are not affected
+	other, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Write([]byte("pong"))
+	if accepted, err = server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(accepted, got); err != nil || string(got) != "pong" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestStream_WriteAfterPeerClose(t *testing.T) {
+	client, server := newSessions(t, &mux.Config{Window: 1 << 10})
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stream.Write(make([]byte, 1<<10))
+
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data arrived, the window is used up
+	if _, err = io.ReadFull(accepted, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+
+	// the unread data was granted back, the peer may go on writing and
+	// what it sends is dropped
+	if _, err = stream.Write(make([]byte, 4<<10)); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Write([]byte("pong"))
+	if accepted, err = server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err = io.ReadFull(accepted, got); err != nil || string(got) != "pong" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestSession_OverConn(t *testing.T) {
+	a, b := net.Pipe()
+
+	serverCh := make(chan *CVLAN.Conn, 1)
+	go func() {
+		conn, err := CVLAN.NewServer(&CVLAN.ServerCfg{Context: context.Background(), Conn: b})
+		if err != nil {
+			t.Error(err)
+		}
+		serverCh <- conn
+	}()
+	conn, err := CVLAN.NewClient(&CVLAN.ClientCfg{Context: context.Background(), Conn: a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := <-serverCh
+	if serverConn == nil {
+		t.FailNow()
+	}
+
+	client, server := mux.Client(conn, nil), mux.Server(serverConn, nil)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.CloseWrite()
+			}()
+		}
+	}()
+
+	for _, msg := range []string{"control", "bulk"} {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write([]byte(msg))
+		stream.CloseWrite()
+		got, err := io.ReadAll(stream)
+		if err != nil || string(got) != msg {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is one bidirectional byte stream of a Session. Each direction has
+// its own flow control window, so a stream that isn't read only ever stalls
+// its own sender.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu sync.Mutex
+
+	recvBuf bytes.Buffer
+	// bytes read by the application and not yet granted back to the peer
+	consumed uint32
+	// bytes the peer may still send before its next window update
+	recvWindow uint32
+	sendWindow uint32
+
+	localFIN  bool // CloseWrite or Close was called
+	localRead bool // Close was called, incoming data is discarded
+	remoteFIN bool // the peer finished writing
+	reset     bool
+
+	readReady  chan struct{}
+	writeReady chan struct{}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    s,
+		recvWindow: s.cfg.Window,
+		sendWindow: s.cfg.Window,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified, the deadline passes or the session
+// closes. The caller must not hold mu.
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.done:
+		return st.session.err
+	}
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read returns io.EOF once the peer finished writing and everything it sent
+// was read.
+func (st *Stream) Read(p []byte) (n int, err error) {
+	for {
+		st.mu.Lock()
+		switch {
+		case st.localRead:
+			err = ErrStreamClosed
+		case st.recvBuf.Len() > 0:
+			n, _ = st.recvBuf.Read(p)
+			st.consumed += uint32(n)
+		case st.reset:
+			err = ErrStreamReset
+		case st.remoteFIN:
+			err = io.EOF
+		case !st.readDeadline.IsZero() && !time.Now().Before(st.readDeadline):
+			err = os.ErrDeadlineExceeded
+		}
+		deadline := st.readDeadline
+		grant := st.takeGrant()
+		st.mu.Unlock()
+
+		if grant > 0 {
+			st.session.writeFrame(frameWindow, 0, st.id, nil, grant)
+		}
+		if n > 0 || err != nil {
+			return
+		}
+		if err = st.wait(st.readReady, deadline); err != nil {
+			return
+		}
+	}
+}
+
+// takeGrant returns the window to give back to the peer once half of it has
+// been read, the caller holds mu.
+func (st *Stream) takeGrant() uint32 {
+	if st.reset || st.consumed < st.session.cfg.Window/2 {
+		return 0
+	}
+	grant := st.consumed
+	st.recvWindow += grant
+	st.consumed = 0
+	return grant
+}
+
+func (st *Stream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			err = ErrStreamReset
+		case st.localFIN:
+			err = ErrStreamClosed
+		case !st.writeDeadline.IsZero() && !time.Now().Before(st.writeDeadline):
+			err = os.ErrDeadlineExceeded
+		}
+		size := uint32(len(p))
+		if size > st.sendWindow {
+			size = st.sendWindow
+		}
+		if size > maxFrameSize {
+			size = maxFrameSize
+		}
+		st.sendWindow -= size
+		deadline := st.writeDeadline
+		st.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+		if size == 0 {
+			if err = st.wait(st.writeReady, deadline); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err = st.session.writeFrame(frameData, 0, st.id, p[:size], 0); err != nil {
+			return
+		}
+		n += int(size)
+		p = p[size:]
+	}
+	return
+}
+
+// CloseWrite finishes the sending direction, the peer reads io.EOF after
+// the data written so far. Reading goes on until the peer finishes too.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.localFIN || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localFIN = true
+	done := st.remoteFIN
+	st.mu.Unlock()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+	notify(st.writeReady)
+	return st.session.writeFrame(frameWindow, flagFIN, st.id, nil, 0)
+}
+
+// Close finishes the sending direction like CloseWrite and stops reading,
+// data the peer still sends is dropped.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	st.localRead = true
+	grant := st.consumed + uint32(st.recvBuf.Len())
+	st.recvBuf.Reset()
+	st.recvWindow += grant
+	st.consumed = 0
+	st.mu.Unlock()
+
+	notify(st.readReady)
+	if grant > 0 {
+		st.session.writeFrame(frameWindow, 0, st.id, nil, grant)
+	}
+	return st.CloseWrite()
+}
+
+// Reset aborts the stream in both directions, the peer's Read and Write
+// fail with ErrStreamReset.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	if st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.reset = true
+	st.mu.Unlock()
+
+	st.session.removeStream(st.id)
+	notify(st.readReady)
+	notify(st.writeReady)
+	return st.session.writeFrame(frameWindow, flagRST, st.id, nil, 0)
+}
+
+func (st *Stream) receive(payload []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if uint32(len(payload)) > st.recvWindow {
+		return errProtocol
+	}
+	if st.reset || st.remoteFIN {
+		return nil
+	}
+	if st.localRead {
+		// nobody reads anymore, give the window straight back
+		go st.session.writeFrame(frameWindow, 0, st.id, nil, uint32(len(payload)))
+		return nil
+	}
+
+	st.recvWindow -= uint32(len(payload))
+	st.recvBuf.Write(payload)
+	notify(st.readReady)
+	return nil
+}
+
+func (st *Stream) grantWindow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writeReady)
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteFIN = true
+	done := st.localFIN
+	st.mu.Unlock()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+	notify(st.readReady)
+}
+
+func (st *Stream) remoteReset() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+
+	st.session.removeStream(st.id)
+	notify(st.readReady)
+	notify(st.writeReady)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.Addr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	if a, ok := st.session.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return a.RemoteAddr()
+	}
+	return muxAddr{}
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readReady)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeReady)
+	return nil
+}
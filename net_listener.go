@@ -13,10 +13,6 @@ func NewTCPListener(addr string) (*net.TCPListener, error) {
 	return net.ListenTCP("tcp", tcpAddr)
 }
 
-func NewTCPListenerWithTLS(addr string, cfg *tls.Config) (*net.TCPListener, error) {
-	listener, err := tls.Listen("tcp", addr, cfg)
-	if err != nil {
-		return nil, err
-	}
-	return listener.(*net.TCPListener), nil
+func NewTCPListenerWithTLS(addr string, cfg *tls.Config) (net.Listener, error) {
+	return tls.Listen("tcp", addr, cfg)
 }
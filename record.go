@@ -0,0 +1,167 @@
+package CVLAN
+
+import (
+	"errors"
+	"github.com/cvlan/core/util"
+	"io"
+	"time"
+)
+
+// recordType is the first byte of every record on the wire.
+type recordType uint8
+
+const (
+	recordHandshake recordType = iota + 1
+	recordData
+	recordRekey
+	recordAlert
+	recordKeepalive
+)
+
+const (
+	// type(1) + payload length(4)
+	recordHeaderSize = 5
+
+	// Write splits plaintext into records of at most this size
+	maxRecordPlaintext = 1 << 16
+
+	// upper bound of a single record payload, a sealed maxRecordPlaintext
+	// with room for the inner type and the cipher's overhead. Larger
+	// lengths are treated as a corrupted stream.
+	maxRecordPayload = maxRecordPlaintext + 256
+
+	// upper bound of a handshake record. They are read before the peer is
+	// authenticated, so a bogus length mustn't cost much.
+	maxHandshakeRecord = 1 << 14
+
+	// fill grows the pending record by at least this much at a time, the
+	// buffer only gets as large as what actually arrived
+	recordGrowStep = 1 << 12
+)
+
+var (
+	errRecordTooLarge   = errors.New("record too large")
+	errUnexpectedRecord = errors.New("unexpected record type")
+)
+
+func (c *Conn) writeRecord(typ recordType, payload []byte) error {
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if len(payload) > maxRecordSize(typ) {
+		return errRecordTooLarge
+	}
+
+	buf := bytesBufferPool.Alloc()
+	defer buf.Free()
+	buf.Val().WriteByte(byte(typ))
+	buf.Val().Write(util.TypeEncoder[uint32](uint32(len(payload))))
+	buf.Val().Write(payload)
+
+	n, err := c.write(buf.Val())
+	if err != nil && n > 0 {
+		c.writeErr = err
+	}
+	return err
+}
+
+func maxRecordSize(typ recordType) int {
+	if typ == recordHandshake {
+		return maxHandshakeRecord
+	}
+	return maxRecordPayload
+}
+
+// fill reads until the pending record holds n bytes. The buffer grows as
+// bytes arrive, a length in a header alone allocates little.
+func (c *Conn) fill(n int) error {
+	for len(c.in) < n {
+		if cap(c.in) == len(c.in) {
+			size := max(2*cap(c.in), len(c.in)+recordGrowStep)
+			in := make([]byte, len(c.in), min(size, n))
+			copy(in, c.in)
+			c.in = in
+		}
+		m, err := c.read(c.in[len(c.in):min(cap(c.in), n)])
+		c.in = c.in[:len(c.in)+m]
+		if err == io.EOF && len(c.in) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRecord reads the next record. Bytes read before an error stay in c.in,
+// so a read interrupted by a deadline picks up where it stopped.
+func (c *Conn) readRecord() (recordType, []byte, error) {
+	if err := c.fill(recordHeaderSize); err != nil {
+		return 0, nil, err
+	}
+
+	typ := recordType(c.in[0])
+	size := util.TypeDecoder[uint32](c.in[1:recordHeaderSize])
+	if size > uint32(maxRecordSize(typ)) {
+		return 0, nil, errRecordTooLarge
+	}
+
+	if err := c.fill(recordHeaderSize + int(size)); err != nil {
+		return 0, nil, err
+	}
+
+	record := c.in
+	c.in = nil
+	return typ, record[recordHeaderSize:], nil
+}
+
+// readRecordOf reads the next record and fails unless it has the given type.
+// An alert in its place fails with the peer's AlertError.
+func (c *Conn) readRecordOf(typ recordType) ([]byte, error) {
+	t, payload, err := c.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	if t == recordAlert && len(payload) == 1 {
+		return nil, &AlertError{Alert: Alert(payload[0]), Remote: true}
+	}
+	if t != typ {
+		return nil, errUnexpectedRecord
+	}
+	return payload, nil
+}
+
+// writeSealed encrypts payload behind its record type and sends it. The type
+// inside the ciphertext is checked by readSealed, so a record can't be passed
+// off as another type by rewriting its header. The caller holds writeMu.
+func (c *Conn) writeSealed(typ recordType, payload []byte) error {
+	text := bytesBufferPool.Alloc()
+	defer text.Free()
+	text.Val().WriteByte(byte(typ))
+	text.Val().Write(payload)
+
+	sealed, err := c.writeCrypt.Encrypt(text.Val().Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	return c.writeRecord(typ, sealed)
+}
+
+// readSealed reads and decrypts the next record, the caller holds readMu.
+func (c *Conn) readSealed() (recordType, []byte, error) {
+	typ, payload, err := c.readRecord()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	text, err := c.readCrypt.Decrypt(payload, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(text) == 0 || recordType(text[0]) != typ {
+		return 0, nil, errUnexpectedRecord
+	}
+	c.keepalive.lastRecv.Store(time.Now().UnixNano())
+	return typ, text[1:], nil
+}
@@ -0,0 +1,93 @@
+package CVLAN
+
+import (
+	"errors"
+	"time"
+)
+
+// RekeyPolicy sets when a session replaces its keys. Each side replaces the
+// keys it sends with on its own, once the first limit is reached, zero
+// disables a limit.
+type RekeyPolicy struct {
+	Bytes    uint64
+	Records  uint64
+	Interval time.Duration
+}
+
+func (p RekeyPolicy) exceeded(bytes, records uint64, since time.Time) bool {
+	return (p.Bytes > 0 && bytes >= p.Bytes) ||
+		(p.Records > 0 && records >= p.Records) ||
+		(p.Interval > 0 && time.Since(since) >= p.Interval)
+}
+
+// rekey message, carried in a recordRekey record sealed with the old keys
+//
+//	sender                   receiver
+//	update          ------>  opens later records with the next keys
+//
+// Both directions have their own traffic secret, the sender moves to the
+// next one right after the update and the receiver once it read it. Nobody
+// waits for an answer, so a side that only writes replaces its keys too and
+// the read path never writes. The next secret is derived from the current
+// one, which is dropped, so the new keys don't expose earlier traffic.
+const rekeyUpdate uint8 = 1
+
+var errUnexpectedRekey = errors.New("unexpected rekey message")
+
+// rekeyState is guarded by Conn.writeMu.
+type rekeyState struct {
+	policy RekeyPolicy
+
+	bytes   uint64
+	records uint64
+	since   time.Time
+}
+
+func (r *rekeyState) reset() {
+	r.bytes, r.records, r.since = 0, 0, time.Now()
+}
+
+// accountWrite records a sent record and replaces the send keys once the
+// policy is exceeded, the caller holds writeMu.
+func (c *Conn) accountWrite(n int) error {
+	r := &c.rekey
+	r.bytes += uint64(n)
+	r.records++
+
+	if !r.policy.exceeded(r.bytes, r.records, r.since) {
+		return nil
+	}
+
+	secret, err := nextSecret(c.keys.sendSecret)
+	if err != nil {
+		return err
+	}
+	next, err := c.keys.trafficCipher(secret)
+	if err != nil {
+		return err
+	}
+	if err = c.writeSealed(recordRekey, []byte{rekeyUpdate}); err != nil {
+		return err
+	}
+	c.keys.sendSecret, c.writeCrypt = secret, next
+	r.reset()
+	return nil
+}
+
+// handleRekey processes a rekey message on the read path, the caller holds
+// readMu.
+func (c *Conn) handleRekey(msg []byte) error {
+	if len(msg) != 1 || msg[0] != rekeyUpdate {
+		return errUnexpectedRekey
+	}
+	secret, err := nextSecret(c.keys.recvSecret)
+	if err != nil {
+		return err
+	}
+	next, err := c.keys.trafficCipher(secret)
+	if err != nil {
+		return err
+	}
+	c.keys.recvSecret, c.readCrypt = secret, next
+	return nil
+}
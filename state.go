@@ -0,0 +1,35 @@
+package CVLAN
+
+// StateKey identifies a value of type T that handshake steps share with
+// later steps and with the application. Keys compare by identity, two keys
+// with the same name don't collide.
+type StateKey[T any] struct {
+	name string
+}
+
+// NewStateKey returns a new key, name only serves debugging.
+func NewStateKey[T any](name string) *StateKey[T] {
+	return &StateKey[T]{name: name}
+}
+
+func (k *StateKey[T]) String() string {
+	return k.name
+}
+
+// SetState stores v under key on the connection.
+func SetState[T any](c *Conn, key *StateKey[T], v T) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state == nil {
+		c.state = make(map[any]any)
+	}
+	c.state[key] = v
+}
+
+// GetState returns the value stored under key and whether there is one.
+func GetState[T any](c *Conn, key *StateKey[T]) (T, bool) {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	v, ok := c.state[key].(T)
+	return v, ok
+}
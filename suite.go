@@ -0,0 +1,214 @@
+package CVLAN
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"github.com/cvlan/core/crypto"
+)
+
+// ProtocolVersion is the handshake version this package speaks.
+const ProtocolVersion uint8 = 1
+
+// KeyExchange names a key exchange the handshake can negotiate.
+type KeyExchange uint8
+
+const (
+	X25519 KeyExchange = iota + 1
+	// X25519MLKEM768 is X25519 combined with ML-KEM-768, secure as long as
+	// either is. Its shares are about 1.2 kB.
+	X25519MLKEM768
+	// NIST curves for deployments that can't use Curve25519. Static
+	// identities are Curve25519 keys, so with these the peers authenticate
+	// with certificates or a PSK.
+	P256
+	P384
+	P521
+)
+
+// Cipher names an AEAD the handshake can negotiate for the session.
+type Cipher uint8
+
+const (
+	AES256GCM Cipher = iota + 1
+	// ChaCha20Poly1305 and XChaCha20Poly1305 are faster than AES256GCM on
+	// hardware without AES instructions.
+	ChaCha20Poly1305
+	XChaCha20Poly1305
+)
+
+// suites offered or accepted when the config sets none, in preference order
+var (
+	defaultKeyExchanges = []KeyExchange{X25519}
+	defaultCiphers      = []Cipher{AES256GCM}
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrNoCommonSuite      = errors.New("no common key exchange or cipher")
+
+	errMalformedShare = errors.New("malformed key share")
+)
+
+// kexClient is the side of a key exchange that offers a share first and
+// completes it with the answer.
+type kexClient interface {
+	Share() []byte
+	Finish(peerShare []byte) ([]byte, error)
+}
+
+// kexServer answers a share with its own and the shared secret.
+type kexServer interface {
+	Respond(peerShare []byte) (share, shared []byte, err error)
+}
+
+type keyExchange struct {
+	newClient func() (kexClient, error)
+	newServer func() (kexServer, error)
+}
+
+var keyExchanges = map[KeyExchange]keyExchange{
+	X25519: {
+		newClient: func() (kexClient, error) { return newX25519Kex() },
+		newServer: func() (kexServer, error) { return newX25519Kex() },
+	},
+	X25519MLKEM768: {
+		newClient: func() (kexClient, error) { return newHybridKex(true) },
+		newServer: func() (kexServer, error) { return newHybridKex(false) },
+	},
+	P256: nistKeyExchange(elliptic.P256()),
+	P384: nistKeyExchange(elliptic.P384()),
+	P521: nistKeyExchange(elliptic.P521()),
+}
+
+func nistKeyExchange(curve elliptic.Curve) keyExchange {
+	return keyExchange{
+		newClient: func() (kexClient, error) { return newNISTKex(curve) },
+		newServer: func() (kexServer, error) { return newNISTKex(curve) },
+	}
+}
+
+var ciphers = map[Cipher]func(sealKey, openKey []byte) (crypto.AES, error){
+	AES256GCM:         crypto.NewGCM,
+	ChaCha20Poly1305:  crypto.NewChaCha20Poly1305,
+	XChaCha20Poly1305: crypto.NewXChaCha20Poly1305,
+}
+
+func (k KeyExchange) String() string {
+	switch k {
+	case X25519:
+		return "X25519"
+	case X25519MLKEM768:
+		return "X25519MLKEM768"
+	case P256:
+		return "P-256"
+	case P384:
+		return "P-384"
+	case P521:
+		return "P-521"
+	}
+	return fmt.Sprintf("KeyExchange(%d)", uint8(k))
+}
+
+func (c Cipher) String() string {
+	switch c {
+	case AES256GCM:
+		return "AES-256-GCM"
+	case ChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	case XChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	}
+	return fmt.Sprintf("Cipher(%d)", uint8(c))
+}
+
+// ecdhKex adapts a crypto.ECDH to a key exchange, both roles send a public
+// key of size bytes.
+type ecdhKex[Pub any] struct {
+	ecdh crypto.ECDH[Pub]
+	size int
+	peer *Pub
+}
+
+func newECDHKex[Pub any](newECDH func() (crypto.ECDH[Pub], error), size int) (*ecdhKex[Pub], error) {
+	ecdh, err := newECDH()
+	if err != nil {
+		return nil, err
+	}
+	return &ecdhKex[Pub]{ecdh: ecdh, size: size}, nil
+}
+
+func newX25519Kex() (*ecdhKex[crypto.PubKey], error) {
+	return newECDHKex(crypto.NewCurve25519ECDH, 32)
+}
+
+// newNISTKex returns a key exchange on curve, whose uncompressed points are
+// twice the field size plus one byte.
+func newNISTKex(curve elliptic.Curve) (*ecdhKex[ecdsa.PublicKey], error) {
+	return newECDHKex(func() (crypto.ECDH[ecdsa.PublicKey], error) {
+		return crypto.NewEllipticECDH(curve)
+	}, 1+2*((curve.Params().BitSize+7)/8))
+}
+
+func (x *ecdhKex[Pub]) Share() []byte {
+	return x.ecdh.Marshal()
+}
+
+func (x *ecdhKex[Pub]) Finish(peerShare []byte) ([]byte, error) {
+	if len(peerShare) != x.size {
+		return nil, errMalformedShare
+	}
+	peer, err := x.ecdh.Unmarshal(peerShare)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := x.ecdh.GenerateShared(peer)
+	if err != nil {
+		return nil, err
+	}
+	x.peer = peer
+	return *shared, nil
+}
+
+func (x *ecdhKex[Pub]) Respond(peerShare []byte) ([]byte, []byte, error) {
+	shared, err := x.Finish(peerShare)
+	if err != nil {
+		return nil, nil, err
+	}
+	return x.Share(), shared, nil
+}
+
+// ephemeral hands the keys to the identity step, which mixes them with the
+// static keys. That only works for Curve25519, the static keys' curve.
+func (x *ecdhKex[Pub]) ephemeral() (crypto.ECDH[crypto.PubKey], *crypto.PubKey) {
+	ecdh, ok := any(x.ecdh).(crypto.ECDH[crypto.PubKey])
+	if !ok {
+		return nil, nil
+	}
+	return ecdh, any(x.peer).(*crypto.PubKey)
+}
+
+// checkSuites validates the configured preferences and fills in defaults.
+func checkSuites(kexs []KeyExchange, ciphersPref []Cipher) ([]KeyExchange, []Cipher, error) {
+	if len(kexs) == 0 {
+		kexs = defaultKeyExchanges
+	}
+	if len(ciphersPref) == 0 {
+		ciphersPref = defaultCiphers
+	}
+	if len(kexs) > 0xff || len(ciphersPref) > 0xff {
+		return nil, nil, errors.New("too many suites")
+	}
+	for _, k := range kexs {
+		if _, ok := keyExchanges[k]; !ok {
+			return nil, nil, fmt.Errorf("unknown key exchange %s", k)
+		}
+	}
+	for _, c := range ciphersPref {
+		if _, ok := ciphers[c]; !ok {
+			return nil, nil, fmt.Errorf("unknown cipher %s", c)
+		}
+	}
+	return kexs, ciphersPref, nil
+}
@@ -0,0 +1,358 @@
+package CVLAN
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"github.com/cvlan/core/crypto"
+	"github.com/cvlan/core/util"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTicketLifetime = 24 * time.Hour
+
+	ticketKeyIDSize = 4
+	// random value of the server hello on resumption
+	resumeNonceSize = 32
+)
+
+var (
+	errMalformedTicket  = errors.New("malformed ticket")
+	errNoTicketKeys     = errors.New("no ticket keys")
+	errNoTicketPeer     = errors.New("ticket has no peer key to verify")
+	errUnexpectedResume = errors.New("server resumed a session that wasn't offered")
+)
+
+// TicketKeys seal the resumption tickets a server issues. The newest key
+// seals, older ones still open the tickets they sealed until those expire.
+// Servers behind one address share keys with SetKeys.
+type TicketKeys struct {
+	// Lifetime is how long a ticket is accepted, 24 hours when zero.
+	Lifetime time.Duration
+
+	mu   sync.RWMutex
+	keys []ticketKey
+}
+
+type ticketKey struct {
+	id      [ticketKeyIDSize]byte
+	aead    cipher.AEAD
+	retired time.Time
+}
+
+// NewTicketKeys returns ticket keys with one random key.
+func NewTicketKeys(lifetime time.Duration) (*TicketKeys, error) {
+	k := &TicketKeys{Lifetime: lifetime}
+	if err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func newTicketKey(key [32]byte) (ticketKey, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return ticketKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return ticketKey{}, err
+	}
+	// the id is public, derive it without revealing the key
+	id, err := expand(key[:], "cvlan ticket key id", nil, ticketKeyIDSize)
+	if err != nil {
+		return ticketKey{}, err
+	}
+	t := ticketKey{aead: aead}
+	copy(t.id[:], id)
+	return t, nil
+}
+
+func (k *TicketKeys) empty() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return len(k.keys) == 0
+}
+
+func (k *TicketKeys) lifetime() time.Duration {
+	if k.Lifetime <= 0 {
+		return defaultTicketLifetime
+	}
+	return k.Lifetime
+}
+
+// Rotate seals new tickets with a fresh random key. Keys retired for longer
+// than the lifetime are dropped, nothing they sealed is valid anymore.
+func (k *TicketKeys) Rotate() error {
+	var key [32]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return err
+	}
+	t, err := newTicketKey(key)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	keys := []ticketKey{t}
+	for i, old := range k.keys {
+		if i == 0 {
+			old.retired = now
+		}
+		if now.Sub(old.retired) < k.lifetime() {
+			keys = append(keys, old)
+		}
+	}
+	k.keys = keys
+	return nil
+}
+
+// SetKeys replaces all keys, the first seals and all of them open. The
+// others count as retired now, they are dropped one lifetime later.
+func (k *TicketKeys) SetKeys(keys ...[32]byte) error {
+	if len(keys) == 0 {
+		return errNoTicketKeys
+	}
+	now := time.Now()
+	list := make([]ticketKey, 0, len(keys))
+	for i, key := range keys {
+		t, err := newTicketKey(key)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			t.retired = now
+		}
+		list = append(list, t)
+	}
+
+	k.mu.Lock()
+	k.keys = list
+	k.mu.Unlock()
+	return nil
+}
+
+// sealed ticket: key id | nonce | AEAD(expires | kex | cipher | secret | peer)
+func (k *TicketKeys) seal(plain []byte) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return nil, errNoTicketKeys
+	}
+	key := k.keys[0]
+
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	b := append(key.id[:], nonce...)
+	return key.aead.Seal(b, nonce, plain, key.id[:]), nil
+}
+
+func (k *TicketKeys) open(b []byte) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if len(b) < ticketKeyIDSize {
+		return nil, errMalformedTicket
+	}
+	for _, key := range k.keys {
+		if string(key.id[:]) != string(b[:ticketKeyIDSize]) {
+			continue
+		}
+		b = b[ticketKeyIDSize:]
+		if len(b) < key.aead.NonceSize() {
+			return nil, errMalformedTicket
+		}
+		return key.aead.Open(nil, b[:key.aead.NonceSize()], b[key.aead.NonceSize():], key.id[:])
+	}
+	return nil, errors.New("unknown ticket key")
+}
+
+// Ticket lets a client resume a session with the server that issued it. It
+// holds a secret, keep it like a key.
+type Ticket struct {
+	expires time.Time
+	kex     KeyExchange
+	cipher  Cipher
+	secret  []byte
+	// the server's static key, the peer of the resumed session
+	peer *crypto.PubKey
+	// sealed by the server, opaque to the client
+	sealed []byte
+}
+
+// Expires returns when the server stops accepting the ticket.
+func (t *Ticket) Expires() time.Time {
+	return t.expires
+}
+
+// ticket state, the client's MarshalBinary and the server's sealed
+// plaintext share it
+//
+//	expires | kex | cipher | secret | peer
+//
+// peer is all zeros when the session had no static keys.
+func (t *Ticket) marshalState() []byte {
+	b := util.TypeEncoder[int64](t.expires.Unix())
+	b = append(b, uint8(t.kex), uint8(t.cipher))
+	b = append(b, t.secret...)
+	var peer crypto.PubKey
+	if t.peer != nil {
+		peer = *t.peer
+	}
+	return append(b, peer.Key[:]...)
+}
+
+func (t *Ticket) unmarshalState(b []byte) error {
+	if len(b) != 8+2+keySize+32 {
+		return errMalformedTicket
+	}
+	t.expires = time.Unix(util.TypeDecoder[int64](b[:8]), 0)
+	t.kex, t.cipher = KeyExchange(b[8]), Cipher(b[9])
+	t.secret = append([]byte(nil), b[10:10+keySize]...)
+	var peer crypto.PubKey
+	if copy(peer.Key[:], b[10+keySize:]); peer != (crypto.PubKey{}) {
+		t.peer = &peer
+	}
+	return nil
+}
+
+// MarshalBinary encodes the ticket for storage, secret included.
+func (t *Ticket) MarshalBinary() ([]byte, error) {
+	return append(t.marshalState(), t.sealed...), nil
+}
+
+func (t *Ticket) UnmarshalBinary(b []byte) error {
+	n := 8 + 2 + keySize + 32
+	if len(b) <= n {
+		return errMalformedTicket
+	}
+	if err := t.unmarshalState(b[:n]); err != nil {
+		return err
+	}
+	t.sealed = append([]byte(nil), b[n:]...)
+	return nil
+}
+
+// Ticket returns the resumption ticket the server issued in the handshake,
+// nil if it issues none. Pass it in ClientCfg.Ticket to resume.
+func (c *Conn) Ticket() *Ticket {
+	return c.ticket
+}
+
+// Resumed reports whether the handshake resumed a session from a ticket.
+func (c *Conn) Resumed() bool {
+	return c.resumed
+}
+
+// acceptTicket opens the ticket of hello and returns it when the session
+// can be resumed with a suite both sides still support.
+func (c *Conn) acceptTicket(hello *clientHello) *Ticket {
+	if c.hs.tickets == nil || len(hello.ticket) == 0 {
+		return nil
+	}
+	plain, err := c.hs.tickets.open(hello.ticket)
+	if err != nil {
+		return nil
+	}
+	var t Ticket
+	if t.unmarshalState(plain) != nil || time.Now().After(t.expires) {
+		return nil
+	}
+	if !c.resumable(&t) {
+		return nil
+	}
+	if !containsSuite(hello.kexs, t.kex) || !containsSuite(c.hs.kexs, t.kex) ||
+		!containsSuite(hello.ciphers, t.cipher) || !containsSuite(c.hs.ciphers, t.cipher) {
+		return nil
+	}
+	return &t
+}
+
+// resumable reports whether this side can verify the ticket's peer. A
+// session without static keys, like one over a NIST curve, has none, so
+// VerifyPeer would be skipped.
+func (c *Conn) resumable(t *Ticket) bool {
+	return c.hs.verifyPeer == nil || t.peer != nil
+}
+
+// resume switches to the ticket's session, the caller sent or read the
+// hello with both random values. They make the keys fresh, the ticket's
+// secret authenticates both sides in place of the static keys.
+func (c *Conn) resume(t *Ticket) error {
+	if !c.resumable(t) {
+		return authFailure{errNoTicketPeer}
+	}
+	if c.hs.verifyPeer != nil {
+		if err := c.hs.verifyPeer(t.peer); err != nil {
+			return authFailure{err}
+		}
+	}
+	c.useSuite(nil, t.kex, t.cipher)
+	c.peerIdentity, c.resumed = t.peer, true
+	return c.mixKey(t.secret)
+}
+
+// serverHandshakeWithTicket issues a ticket after the handshake was
+// verified, an empty message when the server has no ticket keys.
+type serverHandshakeWithTicket struct{ *Conn }
+
+func (e *serverHandshakeWithTicket) Do() error {
+	if e.hs.tickets == nil {
+		return e.WriteEncrypted(nil)
+	}
+
+	secret, err := e.keys.resumptionSecret()
+	if err != nil {
+		return err
+	}
+	t := &Ticket{
+		expires: time.Now().Add(e.hs.tickets.lifetime()),
+		kex:     e.kex,
+		cipher:  e.cipher,
+		secret:  secret,
+		peer:    e.peerIdentity,
+	}
+	sealed, err := e.hs.tickets.seal(t.marshalState())
+	if err != nil {
+		return err
+	}
+	return e.WriteEncrypted(append(util.TypeEncoder[int64](t.expires.Unix()), sealed...))
+}
+
+type clientHandshakeWithTicket struct{ *Conn }
+
+func (e *clientHandshakeWithTicket) Do() error {
+	// derived from the transcript before the ticket joins it, like the
+	// server did
+	secret, err := e.keys.resumptionSecret()
+	if err != nil {
+		return err
+	}
+	msg, err := e.ReadEncrypted()
+	if err != nil || len(msg) == 0 {
+		return err
+	}
+	if len(msg) <= 8 {
+		return errMalformedTicket
+	}
+	e.ticket = &Ticket{
+		expires: time.Unix(util.TypeDecoder[int64](msg[:8]), 0),
+		kex:     e.kex,
+		cipher:  e.cipher,
+		secret:  secret,
+		peer:    e.peerIdentity,
+		sealed:  msg[8:],
+	}
+	return nil
+}
+
+func (ServerHandshake) Ticket(conn *Conn) HandShake { return &serverHandshakeWithTicket{conn} }
+func (ClientHandshake) Ticket(conn *Conn) HandShake { return &clientHandshakeWithTicket{conn} }
@@ -0,0 +1,44 @@
+package CVLAN
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Conn runs over any io.ReadWriteCloser. The methods below are used when
+// the transport has them, a net.Conn provides all of them.
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+type addresser interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// transportAddr stands in for the address of a transport that has none.
+type transportAddr struct{}
+
+func (transportAddr) Network() string { return "cvlan" }
+func (transportAddr) String() string  { return "cvlan" }
+
+func setReadDeadline(rwc io.ReadWriteCloser, t time.Time) error {
+	if d, ok := rwc.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+func setWriteDeadline(rwc io.ReadWriteCloser, t time.Time) error {
+	if d, ok := rwc.(writeDeadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return os.ErrNoDeadline
+}